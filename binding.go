@@ -0,0 +1,300 @@
+package geek_web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 参数绑定
+
+/*
+前面我们提供的Query、Form、Param方法都只能一个一个地获取字符串，用户还需要自己转换类型
+对于一个稍微复杂一点的接口，视图函数中一大半的代码都在解析参数，非常不友好
+
+参数绑定就是直接把请求中的数据解析到结构体中，通过结构体的标签决定数据从哪里来
+	1. json	  请求体中的JSON数据，直接交给encoding/json
+	2. form	  表单数据，包括application/x-www-form-urlencoded和multipart/form-data
+	3. query  请求地址上的查询参数
+	4. uri	  路由参数，/user/:id 中的 id
+	5. header 请求头
+
+除了json之外，其他几种数据本质上都是 map[string][]string，所以可以共用同一套解析逻辑
+支持的类型：string、int系列、uint系列、float系列、bool、time.Time、time.Duration，以及它们的切片和指针
+
+type UserReq struct {
+	ID       int64     `uri:"id"`
+	Page     int       `query:"page"`
+	Tags     []string  `query:"tag"`
+	Birthday time.Time `form:"birthday" time_format:"2006-01-02"`
+	Token    *string   `header:"X-Token"`
+}
+*/
+
+// Bind 根据请求的Content-Type自动选择解析方式
+// 1. application/json => BindJSON
+// 2. application/x-www-form-urlencoded、multipart/form-data => BindForm
+// 3. 没有请求体【例如GET请求】 => BindQuery
+func (c *Context) Bind(obj any) error {
+	contentType := c.Request.Header.Get("Content-Type")
+	if contentType == "" {
+		return c.BindQuery(obj)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("Web: 非法的Content-Type %s", contentType)
+	}
+	switch mediaType {
+	case "application/json":
+		return c.BindJSON(obj)
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		return c.BindForm(obj)
+	default:
+		return fmt.Errorf("Web: 不支持的Content-Type %s", mediaType)
+	}
+}
+
+// BindJSON 解析请求体中的JSON数据
+func (c *Context) BindJSON(obj any) error {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return errors.New("Web: 请求体为空")
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(obj); err != nil {
+		return fmt.Errorf("Web: 解析JSON失败 %w", err)
+	}
+	return nil
+}
+
+// BindQuery 解析请求地址上的查询参数，使用 query 标签
+func (c *Context) BindQuery(obj any) error {
+	if c.cacheQuery == nil {
+		c.cacheQuery = c.Request.URL.Query()
+	}
+	return bindValues(obj, "query", func(name string) ([]string, bool) {
+		values, ok := c.cacheQuery[name]
+		return values, ok
+	})
+}
+
+// BindForm 解析表单数据，使用 form 标签
+// 和Request.FormValue一样，请求地址上的查询参数也会一起参与解析，请求体中的数据优先
+func (c *Context) BindForm(obj any) error {
+	if err := c.parseForm(); err != nil {
+		return err
+	}
+	return bindValues(obj, "form", func(name string) ([]string, bool) {
+		values, ok := c.Request.Form[name]
+		return values, ok
+	})
+}
+
+// BindURI 解析路由参数，使用 uri 标签
+func (c *Context) BindURI(obj any) error {
+	return bindValues(obj, "uri", func(name string) ([]string, bool) {
+		value, ok := c.params[name]
+		if !ok {
+			return nil, false
+		}
+		return []string{value}, true
+	})
+}
+
+// BindHeader 解析请求头，使用 header 标签，标签里面的名字不区分大小写
+func (c *Context) BindHeader(obj any) error {
+	return bindValues(obj, "header", func(name string) ([]string, bool) {
+		values, ok := c.Request.Header[textproto.CanonicalMIMEHeaderKey(name)]
+		return values, ok
+	})
+}
+
+// parseForm 解析表单数据，multipart/form-data需要单独解析
+func (c *Context) parseForm() error {
+	if c.cacheBody == nil {
+		c.cacheBody = c.Request.Body
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	var err error
+	if mediaType == "multipart/form-data" {
+		if c.Request.MultipartForm != nil {
+			return nil
+		}
+		maxMemory := c.maxMultipartMemory
+		if maxMemory <= 0 {
+			maxMemory = defaultMultipartMemory
+		}
+		err = c.Request.ParseMultipartForm(maxMemory)
+	} else {
+		err = c.Request.ParseForm()
+	}
+	if err != nil {
+		return fmt.Errorf("Web: 解析表单失败 %w", err)
+	}
+	return nil
+}
+
+// defaultMultipartMemory 解析multipart/form-data的时候，默认最多使用多少内存，超过的部分会写入临时文件
+const defaultMultipartMemory = 32 << 20
+
+// valueGetter 根据名字获取数据，屏蔽掉不同数据来源之间的差异
+type valueGetter func(name string) ([]string, bool)
+
+var timeType = reflect.TypeOf(time.Time{})
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// bindValues 将数据解析到结构体中
+// obj 必须是结构体指针
+// tag 从哪个标签中获取名字，没有标签的字段使用字段名
+func bindValues(obj any, tag string, getter valueGetter) error {
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Pointer || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return errors.New("Web: 只支持绑定到结构体指针")
+	}
+	return bindStruct(val.Elem(), tag, getter)
+}
+
+func bindStruct(val reflect.Value, tag string, getter valueGetter) error {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		// 私有字段不能设置
+		if !field.IsExported() {
+			continue
+		}
+		name, ok := field.Tag.Lookup(tag)
+		name, _, _ = strings.Cut(name, ",")
+		if name == "-" {
+			continue
+		}
+		fieldVal := val.Field(i)
+		// 没有打标签的结构体【不包括time.Time】，继续往里面解析，例如嵌入的结构体
+		if !ok && field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			if err := bindStruct(fieldVal, tag, getter); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		values, ok := getter(name)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if err := setField(fieldVal, field, values); err != nil {
+			return fmt.Errorf("Web: 字段 %s 解析失败 %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setField 设置字段的值，切片会使用全部的数据，其他类型只使用第一个数据
+func setField(val reflect.Value, field reflect.StructField, values []string) error {
+	switch val.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(val.Type().Elem())
+		if err := setField(elem.Elem(), field, values); err != nil {
+			return err
+		}
+		val.Set(elem)
+		return nil
+	case reflect.Slice:
+		// []byte 当作字符串处理
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			val.SetBytes([]byte(values[0]))
+			return nil
+		}
+		slice := reflect.MakeSlice(val.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setField(slice.Index(i), field, []string{value}); err != nil {
+				return err
+			}
+		}
+		val.Set(slice)
+		return nil
+	default:
+		return setValue(val, field, values[0])
+	}
+}
+
+// setValue 将字符串转换成对应的类型
+func setValue(val reflect.Value, field reflect.StructField, value string) error {
+	switch val.Type() {
+	case timeType:
+		t, err := parseTime(value, field.Tag.Get("time_format"))
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(t))
+		return nil
+	case durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		val.SetInt(int64(d))
+		return nil
+	}
+	switch val.Kind() {
+	case reflect.String:
+		val.SetString(value)
+	case reflect.Bool:
+		// 空字符串当作false，例如 ?debug=
+		if value == "" {
+			val.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		val.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, val.Type().Bits())
+		if err != nil {
+			return err
+		}
+		val.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, val.Type().Bits())
+		if err != nil {
+			return err
+		}
+		val.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, val.Type().Bits())
+		if err != nil {
+			return err
+		}
+		val.SetFloat(f)
+	default:
+		return fmt.Errorf("不支持的类型 %s", val.Type())
+	}
+	return nil
+}
+
+// parseTime 解析时间
+// layout 时间格式，默认是RFC3339，unix 和 unixmilli 表示时间戳
+func parseTime(value string, layout string) (time.Time, error) {
+	switch layout {
+	case "":
+		return time.Parse(time.RFC3339, value)
+	case "unix", "unixmilli":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if layout == "unix" {
+			return time.Unix(i, 0), nil
+		}
+		return time.UnixMilli(i), nil
+	default:
+		return time.Parse(layout, value)
+	}
+}
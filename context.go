@@ -7,6 +7,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +17,10 @@ import (
 // Context 请求响应的上下文，请求过来到响应回去的全过程
 // 那这个需要抽象成一个接口吗？
 // 其实没必要，我们需要抽象成接口的一般都是为了解决扩展性问题，而对于上下文一般不会有很大的改动
+//
+// 注意：Context是通过sync.Pool复用的，视图函数返回之后，Context就会被下一个请求拿去使用
+// 所以千万不要在视图函数返回之后还持有*Context，例如在新开的goroutine中使用它
+// 如果确实需要，先把需要的数据拷贝出来，再交给goroutine使用
 type Context struct {
 	// Request 请求。没有自行封装的必要，因为一个请求过来了，一般里面的数据都不会变化
 	Request *http.Request
@@ -31,13 +38,31 @@ type Context struct {
 	Pattern string // 请求地址
 
 	// response: 常用的信息
-	status int               // 状态码
-	data   any               // 需要响应回去的数据：任意数据
-	header map[string]string // 响应头数据
+	status int         // 状态码
+	data   any         // 需要响应回去的数据：任意数据
+	header http.Header // 响应头数据，同一个响应头可以有多个值，例如Set-Cookie、Vary
 
 	// 模板引擎对象
 	t TemplateEngine
 
+	// 参数校验器
+	validator Validator
+
+	// renderers 按照MIME类型注册的Renderer，内容协商的时候使用
+	renderers map[string]Renderer
+	// errorHandler 错误处理函数
+	errorHandler ErrorHandler
+
+	// maxMultipartMemory 解析multipart/form-data的时候，最多使用多少内存
+	maxMultipartMemory int64
+	// bodyTooLarge 读取请求体的时候是否超过了MaxUploadSize的限制
+	bodyTooLarge bool
+	// committed 响应头和状态码是否已经写到Response中了
+	// 流式响应会提前写入，这个时候刷新数据的中间件就不能再写一次了
+	committed bool
+	// describe 不为nil的时候，Typed返回的视图函数只会把请求和响应的类型写进去，不会处理请求
+	describe *TypedInfo
+
 	// mu 加上读写锁，保护Keys信息
 	mu sync.RWMutex
 	// Keys 是一个键值对，实现中间件之间通信
@@ -53,15 +78,40 @@ type Context struct {
 }
 
 func newContext(w http.ResponseWriter, r *http.Request) *Context {
-	return &Context{
-		Request:  r,
-		Response: w,
-		Method:   r.Method,
-		Pattern:  r.URL.Path,
-		header:   map[string]string{},
-		status:   http.StatusOK, // 默认是200，因为状态码不能设置为0，但是int类型的零值是0
-		data:     []byte(""),    // 响应体默认设置为空字符串吧，好像说响应体也不能为零值，对于这个还有点特殊，因为我们定义data类型是any类型的，也可以直接将Context中的data改成[]byte类型
+	c := &Context{header: http.Header{}}
+	c.reset(w, r)
+	return c
+}
+
+// reset 重置上下文，让Context能够被下一个请求复用
+// 上一个请求留下来的数据必须全部清理干净，不然就会出现数据串到其他请求的情况
+// 能复用的map就清空之后复用，减少内存分配
+func (c *Context) reset(w http.ResponseWriter, r *http.Request) {
+	c.Request = r
+	c.Response = w
+	c.Method = r.Method
+	c.Pattern = r.URL.Path
+	c.params = nil
+	c.cacheQuery = nil
+	c.cacheBody = nil
+	c.status = http.StatusOK // 默认是200，因为状态码不能设置为0，但是int类型的零值是0
+	c.data = []byte("")      // 响应体默认设置为空字符串吧，好像说响应体也不能为零值，对于这个还有点特殊，因为我们定义data类型是any类型的，也可以直接将Context中的data改成[]byte类型
+	for k := range c.header {
+		delete(c.header, k)
 	}
+	c.t = nil
+	c.validator = nil
+	c.renderers = nil
+	c.errorHandler = nil
+	c.maxMultipartMemory = 0
+	c.bodyTooLarge = false
+	c.committed = false
+	c.describe = nil
+	c.mu.Lock()
+	for k := range c.Keys {
+		delete(c.Keys, k)
+	}
+	c.mu.Unlock()
 }
 
 // Param 获取请求地址上的参数
@@ -81,14 +131,54 @@ func (c *Context) SetStatusCode(code int) {
 	c.status = code
 }
 
-// SetHeader 设置响应头
+// SetHeader 设置响应头，会覆盖掉之前设置的值
 func (c *Context) SetHeader(key, value string) {
-	c.header[key] = value
+	c.header.Set(key, value)
+}
+
+// AddHeader 添加响应头，不会覆盖之前设置的值，例如多个Link、Vary
+func (c *Context) AddHeader(key, value string) {
+	c.header.Add(key, value)
 }
 
 // DelHeader 删除响应头数据
 func (c *Context) DelHeader(key string) {
-	delete(c.header, key)
+	c.header.Del(key)
+}
+
+// GetHeader 获取请求头
+func (c *Context) GetHeader(key string) string {
+	return c.Request.Header.Get(key)
+}
+
+// ResponseHeader 还没有写出去的响应头，可以直接修改
+// 和Response.Header()不一样，这里的响应头会在刷新数据的时候统一写出去
+func (c *Context) ResponseHeader() http.Header {
+	return c.header
+}
+
+// Committed 响应头和状态码是否已经写到Response中了，写入之后再设置响应头和状态码都是无效的
+func (c *Context) Committed() bool {
+	return c.committed
+}
+
+// writeHeader 把响应头和状态码写到Response中，只会写一次
+// 所有需要写响应头的地方都必须走这里，不然committed就不准了
+func (c *Context) writeHeader() {
+	if c.committed {
+		return
+	}
+	c.committed = true
+	header := c.Response.Header()
+	for k, values := range c.header {
+		// 有些地方会直接往Response中写Cookie【例如session】，这里不能把它们覆盖掉
+		if k == "Set-Cookie" {
+			header[k] = append(header[k], values...)
+			continue
+		}
+		header[k] = append([]string(nil), values...)
+	}
+	c.Response.WriteHeader(c.status)
 }
 
 // SetData 设置需要响应回去的数据
@@ -150,24 +240,166 @@ func (c *Context) Query(key string) (string, error) {
 	return value[0], nil
 }
 
+// DefaultQuery 获取查询参数，不存在的时候返回defaultValue
+func (c *Context) DefaultQuery(key string, defaultValue string) string {
+	value, err := c.Query(key)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// QueryArray 获取重复出现的查询参数
+// ?tag=a&tag=b => QueryArray("tag") => [a, b]
+func (c *Context) QueryArray(key string) ([]string, error) {
+	if c.cacheQuery == nil {
+		c.cacheQuery = c.Request.URL.Query()
+	}
+	values, ok := c.cacheQuery[key]
+	if !ok {
+		return nil, &ParamError{Source: "query", Key: key, Reason: "不存在"}
+	}
+	return values, nil
+}
+
+// QueryMap 获取map形式的查询参数
+// ?filter[name]=jason&filter[age]=18 => QueryMap("filter") => {name: jason, age: 18}
+func (c *Context) QueryMap(key string) (map[string]string, error) {
+	if c.cacheQuery == nil {
+		c.cacheQuery = c.Request.URL.Query()
+	}
+	result := make(map[string]string)
+	for k, values := range c.cacheQuery {
+		// 必须是 key[xxx] 这种格式
+		if len(k) <= len(key)+2 || !strings.HasPrefix(k, key+"[") || !strings.HasSuffix(k, "]") {
+			continue
+		}
+		result[k[len(key)+1:len(k)-1]] = values[0]
+	}
+	if len(result) == 0 {
+		return nil, &ParamError{Source: "query", Key: key, Reason: "不存在"}
+	}
+	return result, nil
+}
+
+// QueryInt 获取查询参数并转换成int
+func (c *Context) QueryInt(key string) (int, error) {
+	value, err := c.QueryArray(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(value[0])
+	if err != nil {
+		return 0, &ParamError{Source: "query", Key: key, Value: value[0], Reason: "不是合法的整数"}
+	}
+	return i, nil
+}
+
+// QueryInt64 获取查询参数并转换成int64
+func (c *Context) QueryInt64(key string) (int64, error) {
+	value, err := c.QueryArray(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(value[0], 10, 64)
+	if err != nil {
+		return 0, &ParamError{Source: "query", Key: key, Value: value[0], Reason: "不是合法的整数"}
+	}
+	return i, nil
+}
+
+// QueryBool 获取查询参数并转换成bool，支持 1、t、true、0、f、false 等写法
+func (c *Context) QueryBool(key string) (bool, error) {
+	value, err := c.QueryArray(key)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(value[0])
+	if err != nil {
+		return false, &ParamError{Source: "query", Key: key, Value: value[0], Reason: "不是合法的布尔值"}
+	}
+	return b, nil
+}
+
+// ParamInt64 获取路由参数并转换成int64
+func (c *Context) ParamInt64(key string) (int64, error) {
+	value, ok := c.params[key]
+	if !ok {
+		return 0, &ParamError{Source: "param", Key: key, Reason: "不存在"}
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, &ParamError{Source: "param", Key: key, Value: value, Reason: "不是合法的整数"}
+	}
+	return i, nil
+}
+
+// ParamUUID 获取路由参数并校验是不是合法的UUID，返回统一转换成小写的UUID
+// 支持 xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx 这种标准格式
+func (c *Context) ParamUUID(key string) (string, error) {
+	value, ok := c.params[key]
+	if !ok {
+		return "", &ParamError{Source: "param", Key: key, Reason: "不存在"}
+	}
+	if !uuidRegexp.MatchString(value) {
+		return "", &ParamError{Source: "param", Key: key, Value: value, Reason: "不是合法的UUID"}
+	}
+	return strings.ToLower(value), nil
+}
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
 // Form 解析请求体数据
 // 注意：我们这只是将请求的body缓存起来了，方便需要多次从请求体中获取数据
 // 一般我们获取请求体数据，还都是从原来request的body中获取
 func (c *Context) Form(key string) (string, error) {
-	if c.cacheBody == nil {
-		c.cacheBody = c.Request.Body
-	}
-	// 必须先使用ParseForm方法
-	if err := c.Request.ParseForm(); err != nil {
+	values, err := c.FormArray(key)
+	if err != nil {
 		return "", err
 	}
+	return values[0], nil
+}
+
+// FormArray 获取重复出现的表单数据，和Request.FormValue一样，请求地址上的查询参数也算在里面
+func (c *Context) FormArray(key string) ([]string, error) {
+	// 必须先解析表单
+	if err := c.parseForm(); err != nil {
+		return nil, err
+	}
 	// 从请求体中解析数据
-	return c.Request.FormValue(key), nil
+	values, ok := c.Request.Form[key]
+	if !ok || len(values) == 0 {
+		return nil, &ParamError{Source: "form", Key: key, Reason: "不存在"}
+	}
+	return values, nil
+}
+
+// ParamError 获取参数失败的错误，错误信息可以直接返回给客户端，一般对应400响应
+type ParamError struct {
+	// Source 参数从哪里来：query、form、param
+	Source string
+	// Key 参数名
+	Key string
+	// Value 参数值，参数不存在的时候为空
+	Value string
+	// Reason 失败的原因
+	Reason string
 }
 
-// SetCookie 这种方法其实没必要封装，因为http包已经内置了一个非常简单的方法
+func (e *ParamError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("Web: %s 参数 %s %s", e.Source, e.Key, e.Reason)
+	}
+	return fmt.Sprintf("Web: %s 参数 %s 的值 %s %s", e.Source, e.Key, e.Value, e.Reason)
+}
+
+// SetCookie 设置Cookie，和其他响应头一起在刷新数据的时候写出去
+// 以前是直接调用http.SetCookie写到Response中，这样Cookie和其他响应头就分成了两个地方
+// 不合法的Cookie会被忽略，和http.SetCookie的行为保持一致
 func (c *Context) SetCookie(cookie *http.Cookie) {
-	http.SetCookie(c.Response, cookie)
+	if v := cookie.String(); v != "" {
+		c.header.Add("Set-Cookie", v)
+	}
 }
 
 // Set is used to store a new key/value pair exclusively for this context.
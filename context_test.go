@@ -0,0 +1,1001 @@
+package geek_web
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/borntodie-new/geek-web/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextBind(t *testing.T) {
+	type Embedded struct {
+		Lang string `query:"lang" form:"lang"`
+	}
+	type bindReq struct {
+		Embedded
+		ID       int64         `uri:"id"`
+		Page     int           `query:"page"`
+		Tags     []string      `query:"tag"`
+		Scores   []uint16      `query:"score"`
+		Debug    bool          `query:"debug"`
+		Ratio    *float64      `query:"ratio"`
+		Birthday time.Time     `query:"birthday" form:"birthday" time_format:"2006-01-02"`
+		Expire   time.Duration `query:"expire"`
+		Name     string        `json:"name" form:"name"`
+		Token    *string       `header:"x-token"`
+		Ignored  string        `query:"-"`
+		private  string
+	}
+
+	testCases := []struct {
+		name    string
+		req     func() *http.Request
+		params  map[string]string
+		bind    func(ctx *Context, obj any) error
+		want    func() bindReq
+		wantErr bool
+	}{
+		{
+			name: "查询参数",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet,
+					"/user?page=2&tag=a&tag=b&score=1&score=2&debug=true&ratio=0.5&birthday=2000-01-02&expire=1m&lang=go&Ignored=x", nil)
+			},
+			bind: (*Context).Bind,
+			want: func() bindReq {
+				ratio := 0.5
+				return bindReq{
+					Embedded: Embedded{Lang: "go"},
+					Page:     2,
+					Tags:     []string{"a", "b"},
+					Scores:   []uint16{1, 2},
+					Debug:    true,
+					Ratio:    &ratio,
+					Birthday: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+					Expire:   time.Minute,
+				}
+			},
+		},
+		{
+			name: "查询参数类型错误",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/user?page=abc", nil)
+			},
+			bind:    (*Context).BindQuery,
+			wantErr: true,
+		},
+		{
+			name: "JSON",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(`{"name":"jason"}`))
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				return req
+			},
+			bind: (*Context).Bind,
+			want: func() bindReq {
+				return bindReq{Name: "jason"}
+			},
+		},
+		{
+			name: "表单",
+			req: func() *http.Request {
+				form := url.Values{"name": {"jason"}, "birthday": {"2000-01-02"}}
+				req := httptest.NewRequest(http.MethodPost, "/user?lang=go", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			},
+			bind: (*Context).Bind,
+			want: func() bindReq {
+				return bindReq{
+					Embedded: Embedded{Lang: "go"},
+					Name:     "jason",
+					Birthday: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+				}
+			},
+		},
+		{
+			name: "multipart表单",
+			req: func() *http.Request {
+				body := &bytes.Buffer{}
+				writer := multipart.NewWriter(body)
+				_ = writer.WriteField("name", "jason")
+				_ = writer.Close()
+				req := httptest.NewRequest(http.MethodPost, "/user", body)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				return req
+			},
+			bind: (*Context).Bind,
+			want: func() bindReq {
+				return bindReq{Name: "jason"}
+			},
+		},
+		{
+			name: "不支持的Content-Type",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader("name"))
+				req.Header.Set("Content-Type", "text/plain")
+				return req
+			},
+			bind:    (*Context).Bind,
+			wantErr: true,
+		},
+		{
+			name: "路由参数",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/user/15", nil)
+			},
+			params: map[string]string{"id": "15"},
+			bind:   (*Context).BindURI,
+			want: func() bindReq {
+				return bindReq{ID: 15}
+			},
+		},
+		{
+			name: "请求头",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/user", nil)
+				req.Header.Set("X-Token", "token")
+				return req
+			},
+			bind: (*Context).BindHeader,
+			want: func() bindReq {
+				token := "token"
+				return bindReq{Token: &token}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(httptest.NewRecorder(), tc.req())
+			ctx.params = tc.params
+			req := bindReq{}
+			err := tc.bind(ctx, &req)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want(), req)
+		})
+	}
+}
+
+func TestContextBindNotStructPointer(t *testing.T) {
+	ctx := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user?page=1", nil))
+	page := 0
+	assert.Error(t, ctx.BindQuery(&page))
+	assert.Error(t, ctx.BindQuery(struct{}{}))
+}
+
+func TestContextShouldBindAndValidate(t *testing.T) {
+	type Address struct {
+		City string `json:"city" validate:"required"`
+	}
+	type validateReq struct {
+		Name    string   `json:"name" validate:"required,min=2,max=8"`
+		Email   string   `json:"email" validate:"omitempty,email"`
+		Role    string   `json:"role" validate:"oneof=admin user"`
+		Age     *int     `json:"age" validate:"omitempty,min=1,max=150"`
+		Tags    []string `json:"tags" validate:"max=2"`
+		Code    string   `json:"code" validate:"omitempty,len=4"`
+		Address *Address `json:"address" validate:"required"`
+	}
+
+	testCases := []struct {
+		name     string
+		body     string
+		wantErrs ValidationErrors
+		wantErr  bool
+	}{
+		{
+			name: "校验通过",
+			body: `{"name":"杰森","email":"jason@example.com","role":"admin","age":18,"tags":["a"],"code":"abcd","address":{"city":"sz"}}`,
+		},
+		{
+			name: "校验失败",
+			body: `{"name":"j","email":"jason","role":"root","age":200,"tags":["a","b","c"],"code":"abc","address":{}}`,
+			wantErrs: ValidationErrors{
+				{Field: "name", Rule: "min", Param: "2", Message: "name 长度不能小于 2"},
+				{Field: "email", Rule: "email", Message: "email 不是合法的邮箱"},
+				{Field: "role", Rule: "oneof", Param: "admin user", Message: "role 只能是 [admin user] 中的一个"},
+				{Field: "age", Rule: "max", Param: "150", Message: "age 不能大于 150"},
+				{Field: "tags", Rule: "max", Param: "2", Message: "tags 长度不能大于 2"},
+				{Field: "code", Rule: "len", Param: "4", Message: "code 长度必须是 4"},
+				{Field: "address.city", Rule: "required", Message: "address.city 是必填字段"},
+			},
+		},
+		{
+			name: "必填字段",
+			body: `{"role":"user"}`,
+			wantErrs: ValidationErrors{
+				{Field: "name", Rule: "required", Message: "name 是必填字段"},
+				{Field: "address", Rule: "required", Message: "address 是必填字段"},
+			},
+		},
+		{
+			name:    "绑定失败",
+			body:    `{"name":`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			ctx := newContext(httptest.NewRecorder(), req)
+			err := ctx.ShouldBindAndValidate(&validateReq{})
+			switch {
+			case tc.wantErr:
+				assert.Error(t, err)
+				_, ok := err.(ValidationErrors)
+				assert.False(t, ok)
+			case tc.wantErrs != nil:
+				assert.Equal(t, tc.wantErrs, err)
+			default:
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTagValidatorInvalidRule(t *testing.T) {
+	type invalidReq struct {
+		Name string `validate:"required,unknown"`
+	}
+	err := NewTagValidator().Validate(&invalidReq{})
+	assert.Error(t, err)
+	_, ok := err.(ValidationErrors)
+	assert.False(t, ok)
+}
+
+type mockValidator struct{}
+
+func (m mockValidator) Validate(obj any) error {
+	return ValidationErrors{{Field: "mock", Rule: "mock", Message: "mock"}}
+}
+
+func TestServerWithValidator(t *testing.T) {
+	s := NewHTTPServer(ServerWithValidator(mockValidator{}))
+	var err error
+	s.GET("/user", func(ctx *Context) {
+		err = ctx.ShouldBindAndValidate(&struct{}{})
+	})
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user", nil))
+	assert.Equal(t, ValidationErrors{{Field: "mock", Rule: "mock", Message: "mock"}}, err)
+}
+
+func TestContextTypedAccessors(t *testing.T) {
+	form := url.Values{"hobby": {"code", "read"}}
+	req := httptest.NewRequest(http.MethodPost,
+		"/user/15?tag=a&tag=b&page=2&big=9007199254740993&debug=true&bad=abc&filter[name]=jason&filter[age]=18&filter=x",
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := newContext(httptest.NewRecorder(), req)
+	ctx.params = map[string]string{"id": "15", "uid": "6BA7B810-9DAD-11D1-80B4-00C04FD430C8", "bad": "abc"}
+
+	tags, err := ctx.QueryArray("tag")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, tags)
+	_, err = ctx.QueryArray("missing")
+	assert.Error(t, err)
+
+	filter, err := ctx.QueryMap("filter")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "jason", "age": "18"}, filter)
+	_, err = ctx.QueryMap("tag")
+	assert.Error(t, err)
+
+	assert.Equal(t, "2", ctx.DefaultQuery("page", "1"))
+	assert.Equal(t, "10", ctx.DefaultQuery("size", "10"))
+
+	page, err := ctx.QueryInt("page")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, page)
+	big, err := ctx.QueryInt64("big")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), big)
+	_, err = ctx.QueryInt("bad")
+	assert.Equal(t, &ParamError{Source: "query", Key: "bad", Value: "abc", Reason: "不是合法的整数"}, err)
+	assert.Equal(t, "Web: query 参数 bad 的值 abc 不是合法的整数", err.Error())
+
+	debug, err := ctx.QueryBool("debug")
+	assert.NoError(t, err)
+	assert.True(t, debug)
+	_, err = ctx.QueryBool("bad")
+	assert.Error(t, err)
+
+	id, err := ctx.ParamInt64("id")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), id)
+	_, err = ctx.ParamInt64("bad")
+	assert.Error(t, err)
+	_, err = ctx.ParamInt64("missing")
+	assert.Equal(t, "Web: param 参数 missing 不存在", err.Error())
+
+	uid, err := ctx.ParamUUID("uid")
+	assert.NoError(t, err)
+	assert.Equal(t, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", uid)
+	_, err = ctx.ParamUUID("bad")
+	assert.Error(t, err)
+
+	hobbies, err := ctx.FormArray("hobby")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"code", "read"}, hobbies)
+	hobby, err := ctx.Form("hobby")
+	assert.NoError(t, err)
+	assert.Equal(t, "code", hobby)
+	_, err = ctx.Form("missing")
+	assert.Error(t, err)
+}
+
+func newUploadRequest(t *testing.T, url string, filename string, content string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("name", "jason")
+	part, err := writer.CreateFormFile("file", filename)
+	assert.NoError(t, err)
+	_, _ = part.Write([]byte(content))
+	_ = writer.Close()
+	req := httptest.NewRequest(http.MethodPost, url, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestContextFormFile(t *testing.T) {
+	ctx := newContext(httptest.NewRecorder(), newUploadRequest(t, "/upload", "hello.txt", "hello world"))
+	fh, err := ctx.FormFile("file")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello.txt", fh.Filename)
+	_, err = ctx.FormFile("missing")
+	assert.Error(t, err)
+	form, err := ctx.MultipartForm()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"jason"}, form.Value["name"])
+
+	dir := t.TempDir()
+	// 目标是目录，使用上传的文件名
+	assert.NoError(t, ctx.SaveUploadedFile(fh, dir))
+	data, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	// 目标是文件，父目录不存在会自动创建
+	dst := filepath.Join(dir, "a", "b", "c.txt")
+	assert.NoError(t, ctx.SaveUploadedFile(fh, dst))
+	data, err = os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	// 不是multipart表单
+	ctx = newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+	_, err = ctx.FormFile("file")
+	assert.Error(t, err)
+}
+
+func TestContextSaveUploadedFileUnsafeName(t *testing.T) {
+	dir := t.TempDir()
+	ctx := newContext(httptest.NewRecorder(), newUploadRequest(t, "/upload", "../../evil.txt", "evil"))
+	fh, err := ctx.FormFile("file")
+	assert.NoError(t, err)
+	// 文件名中的路径会被去掉，只会保存在dir下面
+	fh.Filename = "../../evil.txt"
+	assert.NoError(t, ctx.SaveUploadedFile(fh, dir+"/"))
+	_, err = os.Stat(filepath.Join(dir, "evil.txt"))
+	assert.NoError(t, err)
+	fh.Filename = `..\..\win.txt`
+	assert.NoError(t, ctx.SaveUploadedFile(fh, dir))
+	_, err = os.Stat(filepath.Join(dir, "win.txt"))
+	assert.NoError(t, err)
+	for _, name := range []string{"..", ".", "/", ""} {
+		fh.Filename = name
+		assert.Error(t, ctx.SaveUploadedFile(fh, dir), name)
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	s := NewHTTPServer(ServerWithMaxMultipartMemory(1 << 10))
+	var handled bool
+	s.POST("/upload", func(ctx *Context) {
+		handled = true
+		if _, err := ctx.FormFile("file"); err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetData([]byte("ok"))
+	}, MaxUploadSize(1<<10))
+
+	testCases := []struct {
+		name        string
+		content     string
+		unknownSize bool
+		wantCode    int
+		wantHandled bool
+	}{
+		{name: "没有超过限制", content: "hello", wantCode: http.StatusOK, wantHandled: true},
+		{name: "Content-Length超过限制", content: strings.Repeat("a", 2<<10), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "读取请求体超过限制", content: strings.Repeat("a", 2<<10), unknownSize: true,
+			wantCode: http.StatusRequestEntityTooLarge, wantHandled: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handled = false
+			req := newUploadRequest(t, "/upload", "a.txt", tc.content)
+			if tc.unknownSize {
+				req.ContentLength = -1
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, tc.wantHandled, handled)
+		})
+	}
+
+	// 视图函数直接读取请求体，读超了一样响应413
+	s.POST("/raw", func(ctx *Context) {
+		if _, err := io.ReadAll(ctx.Request.Body); err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+		ctx.SetData([]byte("ok"))
+	}, MaxUploadSize(1<<10))
+	for _, size := range []int{1 << 10, 1<<10 + 1} {
+		req := httptest.NewRequest(http.MethodPost, "/raw", strings.NewReader(strings.Repeat("a", size)))
+		req.ContentLength = -1
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, req)
+		if size > 1<<10 {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+		} else {
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+	}
+}
+
+func TestContextFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+	fsys := fstest.MapFS{"static/style.css": {Data: []byte("body{}")}}
+
+	s := NewHTTPServer()
+	s.GET("/file", func(ctx *Context) {
+		ctx.File(path)
+	})
+	s.GET("/missing", func(ctx *Context) {
+		ctx.File(filepath.Join(dir, "missing.txt"))
+	})
+	s.GET("/dir", func(ctx *Context) {
+		ctx.File(dir)
+	})
+	s.GET("/attachment", func(ctx *Context) {
+		ctx.FileAttachment(path, `2023年 "报告".txt`)
+	})
+	s.GET("/fs/*name", func(ctx *Context) {
+		name, _ := ctx.Param("name")
+		ctx.FileFromFS(fsys, name)
+	})
+	s.GET("/reader", func(ctx *Context) {
+		ctx.DataFromReader(http.StatusCreated, -1, "text/csv", strings.NewReader("a,b\n1,2\n"))
+	})
+
+	testCases := []struct {
+		name       string
+		method     string
+		url        string
+		wantCode   int
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		{
+			name: "文件", method: http.MethodGet, url: "/file", wantCode: http.StatusOK, wantBody: "hello world",
+			wantHeader: map[string]string{"Content-Type": "text/plain; charset=utf-8", "Content-Length": "11"},
+		},
+		{
+			name: "HEAD请求", method: http.MethodHead, url: "/file", wantCode: http.StatusOK,
+			wantHeader: map[string]string{"Content-Length": "11"},
+		},
+		{name: "文件不存在", method: http.MethodGet, url: "/missing", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{name: "目录", method: http.MethodGet, url: "/dir", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{
+			name: "附件", method: http.MethodGet, url: "/attachment", wantCode: http.StatusOK, wantBody: "hello world",
+			wantHeader: map[string]string{"Content-Disposition": `attachment; filename="2023_ ____.txt"; ` +
+				`filename*=UTF-8''2023%E5%B9%B4%20%22%E6%8A%A5%E5%91%8A%22.txt`},
+		},
+		{
+			name: "fs.FS", method: http.MethodGet, url: "/fs/static/style.css", wantCode: http.StatusOK, wantBody: "body{}",
+			wantHeader: map[string]string{"Content-Type": "text/css; charset=utf-8"},
+		},
+		{name: "fs.FS文件不存在", method: http.MethodGet, url: "/fs/static/app.js", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{
+			name: "reader", method: http.MethodGet, url: "/reader", wantCode: http.StatusCreated, wantBody: "a,b\n1,2\n",
+			wantHeader: map[string]string{"Content-Type": "text/csv", "Content-Length": ""},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.url, nil))
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, tc.wantBody, recorder.Body.String())
+			for k, v := range tc.wantHeader {
+				assert.Equal(t, v, recorder.Header().Get(k), k)
+			}
+		})
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestContextDataFromReaderClose(t *testing.T) {
+	s := NewHTTPServer()
+	reader := &closeRecorder{Reader: strings.NewReader("hello")}
+	s.GET("/reader", func(ctx *Context) {
+		ctx.DataFromReader(http.StatusOK, 5, "text/plain", reader)
+	})
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/reader", nil))
+	assert.Equal(t, "hello", recorder.Body.String())
+	assert.True(t, reader.closed)
+}
+
+func TestContextStream(t *testing.T) {
+	s := NewHTTPServer()
+	s.GET("/stream", func(ctx *Context) {
+		ctx.SetHeader("Content-Type", "text/plain")
+		ctx.SetStatusCode(http.StatusAccepted)
+		i := 0
+		clientGone := ctx.Stream(func(w io.Writer) bool {
+			i++
+			_, _ = fmt.Fprintf(w, "chunk%d\n", i)
+			return i < 3
+		})
+		assert.False(t, clientGone)
+		assert.True(t, ctx.Committed())
+		// 已经进入了流式响应，后面再设置的数据都不会写出去
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetData([]byte("ignored"))
+	})
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "chunk1\nchunk2\nchunk3\n", recorder.Body.String())
+	assert.True(t, recorder.Flushed)
+}
+
+func TestContextStreamClientGone(t *testing.T) {
+	s := NewHTTPServer()
+	called := false
+	var clientGone bool
+	s.GET("/stream", func(ctx *Context) {
+		clientGone = ctx.Stream(func(w io.Writer) bool {
+			called = true
+			return true
+		})
+	})
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(reqCtx)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, clientGone)
+	assert.False(t, called)
+}
+
+func TestContextFlushAnyData(t *testing.T) {
+	s := NewHTTPServer()
+	s.GET("/string", func(ctx *Context) {
+		ctx.SetData("hello")
+	})
+	s.GET("/int", func(ctx *Context) {
+		ctx.SetData(42)
+	})
+	s.GET("/nil", func(ctx *Context) {
+		ctx.SetData(nil)
+	})
+	for url, want := range map[string]string{"/string": "hello", "/int": "42", "/nil": ""} {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, url)
+		assert.Equal(t, want, recorder.Body.String(), url)
+	}
+}
+
+func TestSSEventWriteTo(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event SSEvent
+		want  string
+	}{
+		{name: "只有数据", event: SSEvent{Data: "hello"}, want: "data: hello\n\n"},
+		{
+			name:  "全部字段",
+			event: SSEvent{ID: "1", Event: "update", Retry: 3 * time.Second, Data: map[string]int{"count": 1}},
+			want:  "id: 1\nevent: update\nretry: 3000\ndata: {\"count\":1}\n\n",
+		},
+		{name: "多行数据", event: SSEvent{Data: []byte("a\r\nb\nc")}, want: "data: a\ndata: b\ndata: c\n\n"},
+		{name: "单独的回车也是换行", event: SSEvent{Data: "a\rid: 2\r\rb"}, want: "data: a\ndata: id: 2\ndata: \ndata: b\n\n"},
+		{name: "非法换行", event: SSEvent{ID: "1\n2", Event: "a\r\nb", Data: "x"}, want: "id: 12\nevent: ab\ndata: x\n\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			_, err := tc.event.WriteTo(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestContextSSEStream(t *testing.T) {
+	s := NewHTTPServer()
+	var lastEventID string
+	s.GET("/events", func(ctx *Context) {
+		lastEventID = ctx.LastEventID()
+		assert.NoError(t, ctx.SSEvent("hello", "world"))
+		events := make(chan SSEvent)
+		go func() {
+			defer close(events)
+			events <- SSEvent{ID: "6", Data: "a"}
+			// 等待心跳
+			time.Sleep(80 * time.Millisecond)
+			events <- SSEvent{ID: "7", Data: "b"}
+		}()
+		assert.False(t, ctx.SSEStream(events, 30*time.Millisecond))
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "5")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "5", lastEventID)
+	assert.True(t, strings.HasPrefix(string(body), "event: hello\ndata: world\n\nid: 6\ndata: a\n\n: ping\n\n"))
+	assert.True(t, strings.HasSuffix(string(body), "id: 7\ndata: b\n\n"))
+}
+
+// TestContextSSEStreamMarshalError 事件数据序列化失败不能被当成客户端断开了连接
+func TestContextSSEStreamMarshalError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ctx := newContext(recorder, httptest.NewRequest(http.MethodGet, "/events", nil))
+	assert.Error(t, ctx.SSEvent("bad", make(chan int)))
+	assert.False(t, ctx.committed)
+
+	events := make(chan SSEvent, 2)
+	events <- SSEvent{ID: "1", Data: make(chan int)}
+	events <- SSEvent{ID: "2", Data: "ok"}
+	close(events)
+	assert.False(t, ctx.SSEStream(events, 0))
+	assert.Equal(t, "id: 2\ndata: ok\n\n", recorder.Body.String())
+}
+
+func TestContextSSEStreamClientGone(t *testing.T) {
+	s := NewHTTPServer()
+	result := make(chan bool, 1)
+	s.GET("/events", func(ctx *Context) {
+		result <- ctx.SSEStream(make(chan SSEvent), 10*time.Millisecond)
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, server.URL+"/events", nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	// 读到第一个心跳之后断开连接
+	buf := make([]byte, len(": ping\n\n"))
+	_, err = io.ReadFull(resp.Body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ": ping\n\n", string(buf))
+	cancel()
+	_ = resp.Body.Close()
+	select {
+	case clientGone := <-result:
+		assert.True(t, clientGone)
+	case <-time.After(time.Second):
+		t.Fatal("客户端断开之后SSEStream没有返回")
+	}
+}
+
+func TestContextUpgrade(t *testing.T) {
+	s := NewHTTPServer()
+	s.GET("/ws", func(ctx *Context) {
+		ctx.SetHeader("X-Request-Id", "15")
+		conn, err := ctx.Upgrade(&websocket.Upgrader{EnableCompression: true})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 升级之后再设置的数据不会再写出去
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetData([]byte("ignored"))
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = conn.WriteMessage(mt, msg)
+		}
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	conn, resp, err := (&websocket.Dialer{EnableCompression: true}).Dial(context.Background(), url, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "15", resp.Header.Get("X-Request-Id"))
+	assert.True(t, conn.Compressed())
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	mt, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, mt)
+	assert.Equal(t, "hello", string(msg))
+
+	// 不是WebSocket请求，Upgrader直接响应400，刷新数据的中间件不会再写一次
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "ignored")
+}
+
+func TestContextMultiValueHeader(t *testing.T) {
+	s := NewHTTPServer()
+	s.GET("/header", func(ctx *Context) {
+		assert.Equal(t, "gzip", ctx.GetHeader("accept-encoding"))
+		ctx.SetHeader("Content-Type", "text/plain")
+		ctx.AddHeader("Vary", "Accept")
+		ctx.AddHeader("Vary", "Accept-Encoding")
+		ctx.ResponseHeader().Add("Link", `</a.css>; rel=preload`)
+		ctx.ResponseHeader().Add("Link", `</b.js>; rel=preload`)
+		ctx.SetHeader("X-Deleted", "1")
+		ctx.DelHeader("X-Deleted")
+		ctx.SetCookie(&http.Cookie{Name: "a", Value: "1"})
+		ctx.SetCookie(&http.Cookie{Name: "b", Value: "2"})
+		// 不合法的Cookie会被忽略
+		ctx.SetCookie(&http.Cookie{Name: "bad name", Value: "3"})
+		// 直接写到Response中的Cookie也不会被覆盖
+		http.SetCookie(ctx.Response, &http.Cookie{Name: "session", Value: "s"})
+		ctx.String(http.StatusOK, []byte("ok"))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/header", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+
+	header := recorder.Header()
+	assert.Equal(t, "text/plain", header.Get("Content-Type"))
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, header.Values("Vary"))
+	assert.Equal(t, []string{`</a.css>; rel=preload`, `</b.js>; rel=preload`}, header.Values("Link"))
+	assert.Empty(t, header.Values("X-Deleted"))
+	assert.Equal(t, []string{"session=s", "a=1", "b=2"}, header.Values("Set-Cookie"))
+	cookies := recorder.Result().Cookies()
+	assert.Len(t, cookies, 3)
+
+	// Context复用之后，上一个请求的响应头不能带过来
+	s.GET("/empty", func(ctx *Context) {
+		assert.Empty(t, ctx.ResponseHeader())
+	})
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/empty", nil))
+	assert.Empty(t, recorder.Header().Values("Set-Cookie"))
+}
+
+func TestContextRender(t *testing.T) {
+	type user struct {
+		XMLName xml.Name `json:"-" yaml:"-" msgpack:"-" xml:"user"`
+		Name    string   `json:"name" yaml:"name" xml:"name"`
+		Tag     string   `json:"tag,omitempty" yaml:"tag,omitempty" xml:"tag,omitempty"`
+	}
+	data := user{Name: "<杰森>"}
+	testCases := []struct {
+		name            string
+		url             string
+		render          func(ctx *Context)
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name: "XML", url: "/", render: func(ctx *Context) { ctx.XML(http.StatusOK, data) },
+			wantContentType: MIMEXML, wantBody: "<user><name>&lt;杰森&gt;</name></user>",
+		},
+		{
+			name: "YAML", url: "/", render: func(ctx *Context) { ctx.YAML(http.StatusOK, data) },
+			wantContentType: MIMEYAML, wantBody: "name: <杰森>\n",
+		},
+		{
+			name: "JSONP", url: "/?callback=app.cb", render: func(ctx *Context) { ctx.JSONP(http.StatusOK, data) },
+			wantContentType: MIMEJavaScript, wantBody: `/**/app.cb({"name":"\u003c杰森\u003e"});`,
+		},
+		{
+			name: "JSONP没有callback", url: "/", render: func(ctx *Context) { ctx.JSONP(http.StatusOK, data) },
+			wantContentType: MIMEJSON, wantBody: `{"name":"\u003c杰森\u003e"}`,
+		},
+		{
+			name: "PureJSON", url: "/", render: func(ctx *Context) { ctx.PureJSON(http.StatusOK, data) },
+			wantContentType: MIMEJSON, wantBody: `{"name":"<杰森>"}`,
+		},
+		{
+			name: "IndentedJSON", url: "/", render: func(ctx *Context) { ctx.IndentedJSON(http.StatusOK, data) },
+			wantContentType: MIMEJSON, wantBody: "{\n    \"name\": \"\\u003c杰森\\u003e\"\n}",
+		},
+		{
+			name: "AsciiJSON", url: "/", render: func(ctx *Context) { ctx.AsciiJSON(http.StatusOK, map[string]string{"name": "杰森😀"}) },
+			wantContentType: MIMEJSON, wantBody: `{"name":"\u6770\u68ee\ud83d\ude00"}`,
+		},
+		{
+			name: "MsgPack", url: "/", render: func(ctx *Context) { ctx.MsgPack(http.StatusOK, data) },
+			wantContentType: MIMEMsgPack, wantBody: "\x81\xa4name\xa8<杰森>",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.url, nil))
+			tc.render(ctx)
+			assert.Equal(t, http.StatusOK, ctx.status)
+			assert.Equal(t, tc.wantContentType, ctx.header.Get("Content-Type"))
+			assert.Equal(t, tc.wantBody, string(ctx.data.([]byte)))
+		})
+	}
+
+	// 非法的callback
+	ctx := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?callback=alert(1)", nil))
+	assert.Panics(t, func() { ctx.JSONP(http.StatusOK, data) })
+}
+
+func TestMarshalMsgPack(t *testing.T) {
+	str := func(n int) string { return strings.Repeat("a", n) }
+	testCases := []struct {
+		name string
+		data any
+		want []byte
+	}{
+		{name: "nil", data: nil, want: []byte{0xc0}},
+		{name: "bool", data: []bool{true, false}, want: []byte{0x92, 0xc3, 0xc2}},
+		{name: "positive fixint", data: 127, want: []byte{0x7f}},
+		{name: "negative fixint", data: -32, want: []byte{0xe0}},
+		{name: "int8", data: -33, want: []byte{0xd0, 0xdf}},
+		{name: "int16", data: -129, want: []byte{0xd1, 0xff, 0x7f}},
+		{name: "int32", data: int32(-32769), want: []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{name: "int64", data: int64(math.MinInt64), want: []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{name: "uint8", data: uint(200), want: []byte{0xcc, 0xc8}},
+		{name: "uint16", data: 256, want: []byte{0xcd, 0x01, 0x00}},
+		{name: "uint32", data: 65536, want: []byte{0xce, 0, 1, 0, 0}},
+		{name: "uint64", data: uint64(math.MaxUint64), want: []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "float32", data: float32(1.5), want: []byte{0xca, 0x3f, 0xc0, 0, 0}},
+		{name: "float64", data: 1.5, want: []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{name: "fixstr", data: "abc", want: []byte{0xa3, 'a', 'b', 'c'}},
+		{name: "str8", data: str(32), want: append([]byte{0xd9, 32}, str(32)...)},
+		{name: "str16", data: str(256), want: append([]byte{0xda, 1, 0}, str(256)...)},
+		{name: "bin8", data: []byte{1, 2}, want: []byte{0xc4, 2, 1, 2}},
+		{name: "array16", data: make([]int, 16), want: append([]byte{0xdc, 0, 16}, make([]byte, 16)...)},
+		{name: "map", data: map[string]int{"b": 2, "a": 1}, want: []byte{0x82, 0xa1, 'a', 1, 0xa1, 'b', 2}},
+		{
+			name: "struct",
+			data: struct {
+				ID    int `msgpack:"id"`
+				Name  string
+				Email string `json:"email,omitempty"`
+				Skip  string `json:"-"`
+				Ptr   *int
+			}{ID: 1, Name: "a"},
+			want: []byte{0x83, 0xa2, 'i', 'd', 1, 0xa4, 'N', 'a', 'm', 'e', 0xa1, 'a', 0xa3, 'P', 't', 'r', 0xc0},
+		},
+		{name: "timestamp32", data: time.Unix(1, 0), want: []byte{0xd6, 0xff, 0, 0, 0, 1}},
+		{name: "timestamp64", data: time.Unix(1, 1), want: []byte{0xd7, 0xff, 0, 0, 0, 0x04, 0, 0, 0, 1}},
+		{name: "timestamp96", data: time.Unix(-1, 0), want: []byte{0xc7, 12, 0xff, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MarshalMsgPack(tc.data)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+	_, err := MarshalMsgPack(make(chan int))
+	assert.Error(t, err)
+}
+
+type csvRenderer struct{}
+
+func (csvRenderer) ContentType() string {
+	return "text/csv"
+}
+
+func (csvRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return []byte(strings.Join(data.([]string), ",")), nil
+}
+
+// utf8CSVRenderer Content-Type带参数的Renderer
+type utf8CSVRenderer struct {
+	csvRenderer
+}
+
+func (utf8CSVRenderer) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func TestContextNegotiate(t *testing.T) {
+	s := NewHTTPServer(ServerWithRenderer("text/csv", csvRenderer{}), ServerWithRenderer("text/x-csv", utf8CSVRenderer{}))
+	s.GET("/negotiate", func(ctx *Context) {
+		ctx.Negotiate(http.StatusOK, []string{MIMEJSON, MIMEXML, "text/csv"}, []string{"a", "b"})
+	})
+	s.GET("/aliases", func(ctx *Context) {
+		ctx.Negotiate(http.StatusOK, []string{MIMEYAML, MIMEYAML2, MIMEXML, MIMEXML2, MIMEMsgPack, MIMEMsgPack2, "text/x-csv"},
+			[]string{"a", "b"})
+	})
+	testCases := []struct {
+		name            string
+		url             string
+		accept          string
+		wantCode        int
+		wantContentType string
+	}{
+		{name: "没有Accept", wantCode: http.StatusOK, wantContentType: MIMEJSON},
+		{name: "精确匹配", accept: "application/xml", wantCode: http.StatusOK, wantContentType: MIMEXML},
+		{name: "q值", accept: "application/json;q=0.5, text/csv;q=0.9", wantCode: http.StatusOK, wantContentType: "text/csv"},
+		{name: "通配符", accept: "text/*", wantCode: http.StatusOK, wantContentType: "text/csv"},
+		{name: "全部通配符", accept: "*/*", wantCode: http.StatusOK, wantContentType: MIMEJSON},
+		{
+			name: "具体的优先于通配符", accept: "*/*;q=0.8, application/json;q=0.1", wantCode: http.StatusOK,
+			wantContentType: MIMEXML,
+		},
+		{name: "q=0表示不接受", accept: "application/json;q=0, */*;q=0.1", wantCode: http.StatusOK, wantContentType: MIMEXML},
+		{name: "不能接受", accept: "image/png", wantCode: http.StatusNotAcceptable},
+		// 同一个Renderer注册在多个MIME类型上的时候，响应客户端要的那个
+		{name: "x-yaml", url: "/aliases", accept: "application/x-yaml", wantCode: http.StatusOK, wantContentType: MIMEYAML2},
+		{name: "text/xml", url: "/aliases", accept: "text/xml", wantCode: http.StatusOK, wantContentType: MIMEXML2},
+		{name: "x-msgpack", url: "/aliases", accept: "application/x-msgpack", wantCode: http.StatusOK, wantContentType: MIMEMsgPack2},
+		{name: "保留charset", url: "/aliases", accept: "text/x-csv", wantCode: http.StatusOK, wantContentType: "text/x-csv; charset=utf-8"},
+		// 406 和其他默认的错误一样，客户端能接受JSON的时候响应Problem
+		{name: "406 Problem", url: "/aliases", accept: "application/json", wantCode: http.StatusNotAcceptable, wantContentType: MIMEProblemJSON},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.url == "" {
+				tc.url = "/negotiate"
+			}
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+			if tc.wantContentType != "" {
+				assert.Equal(t, tc.wantContentType, recorder.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
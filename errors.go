@@ -0,0 +1,180 @@
+package geek_web
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+)
+
+// 统一的错误处理
+
+/*
+HandleFunc 没有返回值，视图函数中出现了错误只有两种处理方式
+	1. 直接panic，交给MiddlewareRecovery，但是recovery只知道响应500
+	2. 每个视图函数自己SetStatusCode、SetData，格式五花八门
+
+所以这里提供了另外一种视图函数的签名 HandleFuncE，通过WithError转换成HandleFunc之后再注册，返回的error统一交给错误处理函数处理
+	s.GET("/user/:id", WithError(func(ctx *Context) error {
+		id, err := ctx.ParamInt64("id")
+		if err != nil {
+			return err // ParamError 会响应400
+		}
+		user, ok := users[id]
+		if !ok {
+			return NewHTTPError(http.StatusNotFound, "用户不存在")
+		}
+		ctx.JSON(http.StatusOK, user)
+		return nil
+	}))
+
+错误处理函数可以通过ServerWithErrorHandler替换，默认的错误处理函数
+	1. HTTPError 使用里面的状态码和错误信息
+	2. ParamError、ValidationErrors 响应400
+	3. Problem 原样响应
+	4. 其他的错误一律响应500，错误的细节只会打印到日志中，不会暴露给客户端
+	5. 根据请求头Accept决定响应JSON【Problem】、HTML还是纯文本
+*/
+
+// HandleFuncE 返回error的视图函数
+type HandleFuncE func(ctx *Context) error
+
+// ErrorHandler 错误处理函数
+type ErrorHandler func(ctx *Context, err error)
+
+// HTTPError 带状态码的错误
+type HTTPError struct {
+	// Code HTTP状态码
+	Code int
+	// Message 返回给客户端的错误信息
+	Message string
+	// Err 原始的错误，只会打印到日志中，不会返回给客户端
+	Err error
+}
+
+// NewHTTPError 创建一个带状态码的错误，没有传message的时候使用状态码对应的描述
+func NewHTTPError(code int, message ...string) *HTTPError {
+	e := &HTTPError{Code: code, Message: http.StatusText(code)}
+	if len(message) > 0 {
+		e.Message = message[0]
+	}
+	return e
+}
+
+// Wrap 保存原始的错误
+func (e *HTTPError) Wrap(err error) *HTTPError {
+	e.Err = err
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Web: %d %s %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("Web: %d %s", e.Code, e.Message)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// ServerWithErrorHandler 设置错误处理函数，HandleFuncE返回的error都会交给它处理
+func ServerWithErrorHandler(h ErrorHandler) ServerOption {
+	return func(server *HTTPServer) {
+		server.errorHandler = h
+	}
+}
+
+// HandleError 把错误交给HTTPServer上配置的错误处理函数处理
+// HandleFuncE 返回的error会自动调用这个方法，HandleFunc中也可以手动调用
+func (c *Context) HandleError(err error) {
+	if err == nil {
+		return
+	}
+	h := c.errorHandler
+	if h == nil {
+		h = DefaultErrorHandler
+	}
+	h(c, err)
+}
+
+// DefaultErrorHandler 默认的错误处理函数
+// JSON 格式使用RFC 7807的Problem，参数校验失败的时候每个字段的错误放在扩展字段errors中
+func DefaultErrorHandler(ctx *Context, err error) {
+	var problem *Problem
+	var httpErr *HTTPError
+	var paramErr *ParamError
+	var validationErrs ValidationErrors
+	switch {
+	case errors.As(err, &problem):
+	case errors.As(err, &httpErr):
+		problem = NewProblem(httpErr.Code, httpErr.Message)
+	case errors.As(err, &validationErrs):
+		problem = NewProblem(http.StatusBadRequest, validationErrs.Error()).With("errors", validationErrs)
+	case errors.As(err, &paramErr):
+		problem = NewProblem(http.StatusBadRequest, paramErr.Error())
+	default:
+		problem = NewProblem(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+	if problem.Status == 0 || problem.Instance == "" {
+		// 视图函数返回的Problem可能是一个全局变量，复制一份再修改
+		cp := *problem
+		if cp.Status == 0 {
+			// 没有设置状态码的错误，和ctx.Problem一样当作500
+			cp.Status = http.StatusInternalServerError
+		}
+		if cp.Instance == "" {
+			cp.Instance = ctx.Pattern
+		}
+		problem = &cp
+	}
+	if problem.Status >= http.StatusInternalServerError {
+		log.Printf("REQUEST ERROR %4s - %s %v", ctx.Method, ctx.Pattern, err)
+	}
+	// 流式响应已经把响应头写出去了，这个时候已经没办法再响应错误了
+	if ctx.committed {
+		return
+	}
+	switch ctx.NegotiateFormat(MIMEProblemJSON, MIMEJSON, "text/html") {
+	case MIMEProblemJSON, MIMEJSON:
+	case "text/html":
+		ctx.SetStatusCode(problem.Status)
+		ctx.SetHeader("Content-Type", "text/html; charset=utf-8")
+		ctx.SetData([]byte(fmt.Sprintf("<!DOCTYPE html><html><head><title>%d</title></head><body><h1>%d %s</h1></body></html>",
+			problem.Status, problem.Status, html.EscapeString(problemText(problem)))))
+		return
+	default:
+		// 客户端只接受XML、图片之类的格式，JSON和HTML都不能接受，只能响应纯文本
+		ctx.SetStatusCode(problem.Status)
+		ctx.SetHeader("Content-Type", "text/plain; charset=utf-8")
+		ctx.SetData([]byte(problemText(problem)))
+		return
+	}
+	ctx.Problem(problem)
+}
+
+// WithError 把HandleFuncE转换成HandleFunc，返回的error统一交给错误处理函数处理
+// 和Typed一样，转换之后就是一个普通的HandleFunc，注册路由的方法只需要支持HandleFunc一种签名
+// s.GET("/user/:id", WithError(getUser))
+func WithError(fn HandleFuncE) HandleFunc {
+	if fn == nil {
+		panic("Web: 视图函数不能为nil")
+	}
+	return func(ctx *Context) {
+		if err := fn(ctx); err != nil {
+			ctx.HandleError(err)
+		}
+	}
+}
+
+// problemText HTML和纯文本响应的错误信息，没有Detail的时候依次使用Title和状态码对应的文本
+func problemText(p *Problem) string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	if p.Title != "" {
+		return p.Title
+	}
+	return http.StatusText(p.Status)
+}
@@ -1,12 +1,19 @@
 package geek_web
 
 import (
+	"errors"
 	"fmt"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // 文件处理这块，其实包含三个内容
@@ -17,7 +24,223 @@ import (
 // 文件上传和文件下载没什么好说的，大家自行百度、Google即可，网上一大把的
 // 上传和下载的功能建议能用现成的云服务就用云服务，性能和安全上都很可靠稳定
 
-// 这里我们只实现一个静态文件功能，因为这个功能可以和页面渲染很好的搭配在一起
+// 一开始我们只实现了一个静态文件功能，因为这个功能可以和页面渲染很好的搭配在一起
+// 不过还是有不少用户需要直接接收上传的文件，所以这里也提供了文件上传的功能
+
+// FormFile 获取上传的文件，只返回name对应的第一个文件
+func (c *Context) FormFile(name string) (*multipart.FileHeader, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	files := form.File[name]
+	if len(files) == 0 {
+		return nil, &ParamError{Source: "form", Key: name, Reason: "不存在"}
+	}
+	return files[0], nil
+}
+
+// MultipartForm 解析multipart/form-data表单，包括普通的字段和上传的文件
+// 最多使用多少内存通过ServerWithMaxMultipartMemory配置，超过的部分会写入临时文件
+func (c *Context) MultipartForm() (*multipart.Form, error) {
+	if err := c.parseForm(); err != nil {
+		return nil, err
+	}
+	if c.Request.MultipartForm == nil {
+		return nil, errors.New("Web: 请求不是multipart/form-data表单")
+	}
+	return c.Request.MultipartForm, nil
+}
+
+// SaveUploadedFile 保存上传的文件
+// dst 是目录【已经存在的目录或者以 / 结尾】的时候，使用上传的文件名保存到这个目录下
+// 上传的文件名是客户端给的，完全不可信，这里只会取文件名的最后一段，../../etc/passwd 会保存成 passwd
+// 去掉目录之后只剩下 .、.. 这种特殊文件名的时候返回error
+func (c *Context) SaveUploadedFile(fh *multipart.FileHeader, dst string) error {
+	if info, err := os.Stat(dst); strings.HasSuffix(dst, "/") || (err == nil && info.IsDir()) {
+		name, err := safeFileName(fh.Filename)
+		if err != nil {
+			return err
+		}
+		dst = filepath.Join(dst, name)
+	}
+	dst = filepath.Clean(dst)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, src)
+	return err
+}
+
+// safeFileName 只保留文件名的最后一段，../../evil.txt => evil.txt，并且拒绝 .、.. 这种特殊的文件名
+func safeFileName(name string) (string, error) {
+	// 客户端可能是Windows，路径分隔符是 \
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "", fmt.Errorf("Web: 非法的文件名 %s", name)
+	}
+	return name, nil
+}
+
+// 文件下载也是同样的道理，以前只能把整个文件读到内存中再SetData，大文件直接把内存撑爆
+// 所以这里的ctx.data除了[]byte之外，还可以是一个io.Reader，刷新数据的时候再边读边写到响应中
+
+// File 响应一个文件，Content-Type根据文件的后缀名判断
+// 文件不存在或者是一个目录的时候响应404
+func (c *Context) File(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		c.fileNotFound()
+		return
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		_ = file.Close()
+		c.fileNotFound()
+		return
+	}
+	c.SetHeader("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	// file 会在刷新数据之后关闭
+	c.DataFromReader(http.StatusOK, info.Size(), contentTypeByName(path), file)
+}
+
+// FileAttachment 以附件的形式响应一个文件，浏览器会弹出下载框而不是直接打开
+// filename 下载时显示的文件名，可以和磁盘上的文件名不一样，支持中文
+func (c *Context) FileAttachment(path string, filename string) {
+	c.File(path)
+	if c.status == http.StatusOK {
+		c.SetHeader("Content-Disposition", contentDisposition("attachment", filename))
+	}
+}
+
+// FileFromFS 从fs.FS中响应一个文件，可以配合embed.FS使用
+func (c *Context) FileFromFS(fsys fs.FS, name string) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		c.fileNotFound()
+		return
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		_ = file.Close()
+		c.fileNotFound()
+		return
+	}
+	c.SetHeader("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	c.DataFromReader(http.StatusOK, info.Size(), contentTypeByName(name), file)
+}
+
+// DataFromReader 从reader中读取数据响应回去，不会把全部的数据读到内存中
+// length 数据的长度，小于0表示不知道长度，这个时候不会设置Content-Length
+// reader 如果实现了io.Closer，响应结束之后会自动关闭
+func (c *Context) DataFromReader(code int, length int64, contentType string, reader io.Reader) {
+	c.SetStatusCode(code)
+	if contentType != "" {
+		c.SetHeader("Content-Type", contentType)
+	}
+	if length >= 0 {
+		c.SetHeader("Content-Length", strconv.FormatInt(length, 10))
+	}
+	c.SetData(reader)
+}
+
+func (c *Context) fileNotFound() {
+	c.SetStatusCode(http.StatusNotFound)
+	c.SetData([]byte("404 NOT FOUND"))
+}
+
+// contentTypeByName 根据文件的后缀名判断Content-Type
+func contentTypeByName(name string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// contentDisposition 生成Content-Disposition响应头
+// 按照RFC 6266，filename 给不支持UTF-8的老客户端使用，只保留ASCII字符
+// filename* 使用RFC 5987的编码，支持中文之类的文件名
+func contentDisposition(dispositionType string, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r >= 0x80 || r < 0x20 || r == 0x7f || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for i := 0; i < len(filename); i++ {
+		b := filename[i]
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, dispositionType, fallback.String(), encoded.String())
+}
+
+// isAttrChar RFC 5987中不需要编码的字符
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// MaxUploadSize 限制请求体的大小，超过之后响应413
+// 一般作为路由中间件使用：g.POST("/upload", handler, MaxUploadSize(10<<20))
+// 1. 请求头中的Content-Length超过了限制，直接响应413，不会执行视图函数
+// 2. 没有Content-Length【例如分块传输】的时候，读取请求体超过限制会返回错误，视图函数执行完之后统一响应413
+// 不管视图函数是通过Bind、FormFile还是直接读取ctx.Request.Body，只要读超了都会响应413
+func MaxUploadSize(limit int64) Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(ctx *Context) {
+			if ctx.Request.ContentLength > limit {
+				ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+				ctx.SetData([]byte("413 REQUEST ENTITY TOO LARGE"))
+				return
+			}
+			body := &limitedBody{ReadCloser: ctx.Request.Body, ctx: ctx, limit: limit}
+			ctx.Request.Body = http.MaxBytesReader(ctx.Response, body, limit)
+			next(ctx)
+			if ctx.bodyTooLarge {
+				ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+				ctx.SetData([]byte("413 REQUEST ENTITY TOO LARGE"))
+			}
+		}
+	}
+}
+
+// limitedBody 放在http.MaxBytesReader下面，记录真正从请求体中读了多少数据
+// MaxBytesReader 会多读一个字节来判断是不是超过了限制，读到的数据超过limit就说明请求体太大了
+// http.MaxBytesError 是Go1.19才有的，这样就不需要通过错误信息来判断
+type limitedBody struct {
+	io.ReadCloser
+	ctx   *Context
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		b.ctx.bodyTooLarge = true
+	}
+	return n, err
+}
 
 // StaticFileHandler 静态文件
 type StaticFileHandler struct {
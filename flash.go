@@ -1,5 +1,12 @@
 package geek_web
 
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
 // 会有这个需求的原因
 // 1. 由于http.ResponseWriter的特殊机制，一旦向响应体中写入了数据，后续再想写入或者修改就无效了
 // 2. 统一写入更加友好，不会每写一个返回都需要手动向响应体中写入，要让用户对这一步骤无感
@@ -22,18 +29,50 @@ func (m *MiddlewareFlashData) Builder() Middleware {
 	return func(next HandleFunc) HandleFunc {
 		return func(ctx *Context) {
 			defer func() {
+				// 响应数据是io.Reader【例如文件】的时候，边读边写，不需要全部读到内存中
+				// 能关闭的reader，响应结束之后一定要关闭
+				if closer, ok := ctx.data.(io.Closer); ok {
+					defer closer.Close()
+				}
+				// 流式响应已经自己写过响应了，这里什么都不需要做
+				if ctx.committed {
+					return
+				}
 				// 统一刷新数据到response中
-				// 1. 设置响应头
-				for k, v := range ctx.header {
-					ctx.Response.Header().Set(k, v)
+				var data []byte
+				var reader io.Reader
+				switch val := ctx.data.(type) {
+				case nil:
+				case []byte:
+					data = val
+				case string:
+					data = []byte(val)
+				case io.Reader:
+					reader = val
+				default:
+					// 其他类型的数据就直接转成字符串吧，总比panic好
+					data = []byte(fmt.Sprint(val))
 				}
-				// 2. 设置状态码
-				ctx.Response.WriteHeader(ctx.status)
+				// HEAD 请求不需要响应体，不过还是需要告诉客户端响应体有多长
+				// reader 的长度在DataFromReader中已经设置过了
+				if ctx.Method == http.MethodHead {
+					if reader == nil {
+						ctx.SetHeader("Content-Length", strconv.Itoa(len(data)))
+					}
+					data, reader = nil, nil
+				}
+				// 1. 设置响应头 2. 设置状态码
+				ctx.writeHeader()
 				// 3. 设置响应体
 				// 这里将逻辑改了吧，先recovery，最后在刷新数据
 				// 因为recovery中也需要将错误信息刷新到响应体中
 				// 如果这里也有错误，那也就没办法了
-				_, _ = ctx.Response.Write((ctx.data).([]byte))
+				if len(data) > 0 {
+					_, _ = ctx.Response.Write(data)
+				}
+				if reader != nil {
+					_, _ = io.Copy(ctx.Response, reader)
+				}
 				// 如果刷新数据到响应体中出现错误，直接panic
 				// 后面会有一个recovery hook住panic错误的
 				//if err != nil {
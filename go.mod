@@ -2,12 +2,14 @@ module github.com/borntodie-new/geek-web
 
 go 1.18
 
-require github.com/stretchr/testify v1.8.2
+require (
+	github.com/hashicorp/golang-lru/v2 v2.0.2
+	github.com/stretchr/testify v1.8.2
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/hashicorp/golang-lru v1.0.1 // indirect
-	github.com/hashicorp/golang-lru/v2 v2.0.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,263 @@
+package geek_web
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MessagePack 编码
+
+/*
+MessagePack 可以理解成二进制的JSON，体积更小，编码解码更快，格式定义在 https://msgpack.org
+为了一个Renderer引入一个第三方库不太划算，而且我们只需要编码，不需要解码，所以自己实现一个
+
+	nil				0xc0
+	bool			0xc2 false，0xc3 true
+	整数			 按照大小选择最短的编码：positive fixint、negative fixint、int8~int64、uint8~uint64
+	浮点数			 float32 0xca，float64 0xcb
+	字符串			 fixstr、str8、str16、str32
+	[]byte			bin8、bin16、bin32
+	切片、数组		 fixarray、array16、array32
+	map、结构体		 fixmap、map16、map32
+	time.Time		timestamp扩展类型【-1】
+
+结构体的字段名优先使用msgpack标签，没有的话使用json标签，都没有就使用字段名，同样支持 - 和 omitempty
+*/
+
+// MarshalMsgPack 把数据编码成MessagePack格式
+func MarshalMsgPack(data any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encodeMsgPack(buf, reflect.ValueOf(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeMsgPack(buf *bytes.Buffer, val reflect.Value) error {
+	if !val.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	if val.Type() == timeType {
+		writeMsgPackTime(buf, val.Interface().(time.Time))
+		return nil
+	}
+	switch val.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if val.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMsgPack(buf, val.Elem())
+	case reflect.Bool:
+		if val.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgPackInt(buf, val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgPackUint(buf, val.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		_ = binary.Write(buf, binary.BigEndian, math.Float32bits(float32(val.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(val.Float()))
+	case reflect.String:
+		writeMsgPackString(buf, val.String())
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, val.Len())
+			reflect.Copy(reflect.ValueOf(bs), val)
+			writeMsgPackBinary(buf, bs)
+			return nil
+		}
+		writeMsgPackHeader(buf, val.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < val.Len(); i++ {
+			if err := encodeMsgPack(buf, val.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if val.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMsgPackMap(buf, val)
+	case reflect.Struct:
+		return encodeMsgPackStruct(buf, val)
+	default:
+		return fmt.Errorf("Web: MessagePack不支持的类型 %s", val.Type())
+	}
+	return nil
+}
+
+// encodeMsgPackMap map的遍历顺序是随机的，按照key排序之后再编码，保证同样的数据编码结果一样
+func encodeMsgPackMap(buf *bytes.Buffer, val reflect.Value) error {
+	keys := val.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	writeMsgPackHeader(buf, len(keys), 0x80, 0xde, 0xdf)
+	for _, key := range keys {
+		if err := encodeMsgPack(buf, key); err != nil {
+			return err
+		}
+		if err := encodeMsgPack(buf, val.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMsgPackStruct(buf *bytes.Buffer, val reflect.Value) error {
+	typ := val.Type()
+	names := make([]string, 0, typ.NumField())
+	fields := make([]reflect.Value, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, ok := field.Tag.Lookup("msgpack")
+		if !ok {
+			tag = field.Tag.Get("json")
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldVal := val.Field(i)
+		if strings.Contains(opts, "omitempty") && isEmpty(fieldVal) {
+			continue
+		}
+		names = append(names, name)
+		fields = append(fields, fieldVal)
+	}
+	writeMsgPackHeader(buf, len(names), 0x80, 0xde, 0xdf)
+	for i, name := range names {
+		writeMsgPackString(buf, name)
+		if err := encodeMsgPack(buf, fields[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMsgPackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgPackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func writeMsgPackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		_ = binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		_ = binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		_ = binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func writeMsgPackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n <= 31:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgPackBinary(buf *bytes.Buffer, bs []byte) {
+	n := len(bs)
+	switch {
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xc4, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(bs)
+}
+
+// writeMsgPackHeader 写入数组或者map的长度
+// fix 长度小于16时使用的前缀，b16、b32 分别是16位、32位长度的前缀
+func writeMsgPackHeader(buf *bytes.Buffer, n int, fix byte, b16 byte, b32 byte) {
+	switch {
+	case n <= 15:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMsgPackTime 时间使用timestamp扩展类型【-1】
+// 秒数能用32位表示并且没有纳秒的时候使用timestamp 32，否则使用timestamp 64或者timestamp 96
+func writeMsgPackTime(buf *bytes.Buffer, t time.Time) {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch {
+	case sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		buf.Write([]byte{0xd6, 0xff})
+		_ = binary.Write(buf, binary.BigEndian, uint32(sec))
+	case sec>>34 == 0:
+		buf.Write([]byte{0xd7, 0xff})
+		_ = binary.Write(buf, binary.BigEndian, uint64(nsec)<<34|uint64(sec))
+	default:
+		buf.Write([]byte{0xc7, 12, 0xff})
+		_ = binary.Write(buf, binary.BigEndian, uint32(nsec))
+		_ = binary.Write(buf, binary.BigEndian, sec)
+	}
+}
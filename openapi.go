@@ -0,0 +1,787 @@
+package geek_web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI 接口文档
+
+/*
+接口文档一般是手写的，写着写着就和代码对不上了，最好的办法是直接从代码生成
+路由树上已经有了请求方法和路由，缺的是每个接口的说明、请求和响应的结构，所以
+	1. 注册路由的时候返回一个RouteInfo，可以继续补充说明、标签、请求和响应的类型
+	2. Typed 返回的视图函数本身就知道请求和响应的类型，不需要再手动补充
+	3. 遍历路由树，把每个路由转换成OpenAPI 3.1中的一个Operation，请求和响应的类型通过反射转换成JSON Schema
+
+	s.GET("/user/:id", Typed(getUser)).Summary("获取用户信息").Tags("user")
+	s.POST("/upload", upload).Summary("上传文件").Request(UploadReq{}).Response(UploadResp{})
+
+	info := OpenAPIInfo{Title: "用户服务", Version: "1.0.0"}
+	s.GET("/openapi.json", s.OpenAPIHandler(info)).Hidden()
+	s.GET("/docs", SwaggerUIHandler(info.Title, "/openapi.json")).Hidden()
+
+路由转换规则
+	1. /user/:id			=> /user/{id}
+	2. /order/:id(^[0-9]+$)	=> /order/{id}，参数上带上pattern，和路由树一样整段匹配，也就是 ^(?:^[0-9]+$)$
+	3. /files/<[a-z]+\.pdf>	=> /files/{param1}，这种写法没有参数名，按照出现的顺序编号
+	4. /assets/*filepath	=> /assets/{filepath}
+	注意第4条，通配符参数可以匹配多段路由，例如 /assets/css/main.css 中 filepath 是 css/main.css
+	但是OpenAPI中的路由参数只能是一段，Swagger UI 之类的客户端会把参数里面的 / 转义成 %2F，
+	所以生成的参数上会带一个说明，需要调用这种接口的时候最好自己拼接地址
+
+Swagger UI 的静态资源默认从CDN加载，版本固定是 SwaggerUIVersion，内网或者有严格CSP的时候
+可以把 swagger-ui-dist 放到自己的服务器上，用 SwaggerUIWithAssets 指定地址
+	assets := NewStaticFileHandler("./swagger-ui-dist", "swagger-ui", "filepath")
+	s.GET("/swagger-ui/*filepath", assets.Handler).Hidden()
+	s.GET("/docs", SwaggerUIHandler(info.Title, "/openapi.json", SwaggerUIWithAssets("/swagger-ui"))).Hidden()
+
+请求类型中字段的位置和参数绑定的规则一样
+	1. uri 标签		路由参数
+	2. query 标签	查询参数
+	3. header 标签	请求头
+	4. 其他的字段，POST、PUT、PATCH 放在请求体中，其他的请求方法和BindQuery一样当作查询参数
+validate 标签中的 required、min、max、len、email、oneof 也会转换成JSON Schema中对应的约束
+*/
+
+// RouteInfo 路由的元数据，生成接口文档的时候使用
+type RouteInfo struct {
+	summary     string
+	description string
+	tags        []string
+	request     reflect.Type
+	response    reflect.Type
+	formats     []string // 除了JSON之外还支持的响应格式
+	deprecated  bool
+	hidden      bool
+}
+
+// Summary 接口的简短说明
+func (r *RouteInfo) Summary(summary string) *RouteInfo {
+	r.summary = summary
+	return r
+}
+
+// Description 接口的详细说明
+func (r *RouteInfo) Description(description string) *RouteInfo {
+	r.description = description
+	return r
+}
+
+// Tags 接口的标签，Swagger UI 会按照标签分组展示
+func (r *RouteInfo) Tags(tags ...string) *RouteInfo {
+	r.tags = append(r.tags, tags...)
+	return r
+}
+
+// Request 请求的类型，传一个零值就行，例如 UserReq{} 或者 (*UserReq)(nil)
+func (r *RouteInfo) Request(req any) *RouteInfo {
+	r.request = reflect.TypeOf(req)
+	return r
+}
+
+// Response 响应的类型，传一个零值就行，响应的是JSON数据
+func (r *RouteInfo) Response(resp any) *RouteInfo {
+	r.response = reflect.TypeOf(resp)
+	return r
+}
+
+// Deprecated 标记接口已经废弃
+func (r *RouteInfo) Deprecated() *RouteInfo {
+	r.deprecated = true
+	return r
+}
+
+// Hidden 不出现在接口文档中，例如接口文档本身的路由
+func (r *RouteInfo) Hidden() *RouteInfo {
+	r.hidden = true
+	return r
+}
+
+// OpenAPIVersion 生成的接口文档使用的OpenAPI版本
+const OpenAPIVersion = "3.1.0"
+
+// OpenAPI 接口文档，只包含了我们能够生成的部分
+// 需要其他字段【例如servers、security】的时候，可以把生成的文档序列化之后再自行修改
+type OpenAPI struct {
+	OpenAPI    string                     `json:"openapi" yaml:"openapi"`
+	Info       OpenAPIInfo                `json:"info" yaml:"info"`
+	Paths      map[string]OpenAPIPathItem `json:"paths" yaml:"paths"`
+	Components *OpenAPIComponents         `json:"components,omitempty" yaml:"components,omitempty"`
+}
+
+// OpenAPIInfo 接口文档的基本信息
+type OpenAPIInfo struct {
+	Title       string `json:"title" yaml:"title"`
+	Version     string `json:"version" yaml:"version"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// OpenAPIPathItem 同一个路由下的全部接口，key是小写的请求方法
+type OpenAPIPathItem map[string]*OpenAPIOperation
+
+// OpenAPIOperation 一个接口
+type OpenAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Description string                      `json:"description,omitempty" yaml:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Deprecated  bool                        `json:"deprecated,omitempty" yaml:"deprecated,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses" yaml:"responses"`
+}
+
+// OpenAPIParameter 路由参数、查询参数、请求头
+type OpenAPIParameter struct {
+	Name        string         `json:"name" yaml:"name"`
+	In          string         `json:"in" yaml:"in"`
+	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool           `json:"required,omitempty" yaml:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema" yaml:"schema"`
+}
+
+// OpenAPIRequestBody 请求体
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty" yaml:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content" yaml:"content"`
+}
+
+// OpenAPIResponse 响应
+type OpenAPIResponse struct {
+	Description string                       `json:"description" yaml:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+// OpenAPIMediaType 某一种Content-Type的数据结构
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema" yaml:"schema"`
+}
+
+// OpenAPIComponents 可以复用的数据结构，有名字的结构体都会放在这里，通过$ref引用
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas,omitempty" yaml:"schemas,omitempty"`
+}
+
+// OpenAPISchema JSON Schema，只包含了能从Go的类型和validate标签中推导出来的部分
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty" yaml:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty" yaml:"type,omitempty"`
+	Format               string                    `json:"format,omitempty" yaml:"format,omitempty"`
+	Description          string                    `json:"description,omitempty" yaml:"description,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty" yaml:"required,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty" yaml:"items,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty" yaml:"additionalProperties,omitempty"`
+	Enum                 []any                     `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty" yaml:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty" yaml:"maximum,omitempty"`
+	MinLength            *int                      `json:"minLength,omitempty" yaml:"minLength,omitempty"`
+	MaxLength            *int                      `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	MinItems             *int                      `json:"minItems,omitempty" yaml:"minItems,omitempty"`
+	MaxItems             *int                      `json:"maxItems,omitempty" yaml:"maxItems,omitempty"`
+	MinProperties        *int                      `json:"minProperties,omitempty" yaml:"minProperties,omitempty"`
+	MaxProperties        *int                      `json:"maxProperties,omitempty" yaml:"maxProperties,omitempty"`
+}
+
+// JSON 序列化成JSON格式
+func (o *OpenAPI) JSON() ([]byte, error) {
+	return json.MarshalIndent(o, "", "  ")
+}
+
+// YAML 序列化成YAML格式
+func (o *OpenAPI) YAML() ([]byte, error) {
+	return yaml.Marshal(o)
+}
+
+// OpenAPI 遍历路由树生成接口文档
+// 只有注册过的路由才会出现在文档中，所以要在全部路由注册完之后再调用
+func (s *HTTPServer) OpenAPI(info OpenAPIInfo) *OpenAPI {
+	gen := &openAPIGenerator{
+		schemas: map[string]*OpenAPISchema{},
+		names:   map[reflect.Type]string{},
+		used:    map[string]bool{},
+	}
+	doc := &OpenAPI{
+		OpenAPI: OpenAPIVersion,
+		Info:    info,
+		Paths:   map[string]OpenAPIPathItem{},
+	}
+	for _, rt := range s.router.routes() {
+		method := strings.ToLower(rt.method)
+		// CONNECT 和自定义的请求方法在OpenAPI中没办法表示
+		if !openAPIMethods[method] || rt.node.info == nil || rt.node.info.hidden {
+			continue
+		}
+		path, params := openAPIPath(rt.pattern)
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = OpenAPIPathItem{}
+			doc.Paths[path] = item
+		}
+		item[method] = gen.operation(rt.method, params, rt.node.info)
+	}
+	if len(gen.schemas) > 0 {
+		doc.Components = &OpenAPIComponents{Schemas: gen.schemas}
+	}
+	return doc
+}
+
+// OpenAPIHandler 响应接口文档的视图函数
+// 默认响应JSON，查询参数 format=yaml 或者请求头Accept是YAML的时候响应YAML
+// 每次请求都会重新生成，保证和路由树是一致的
+func (s *HTTPServer) OpenAPIHandler(info OpenAPIInfo) HandleFunc {
+	return func(ctx *Context) {
+		doc := s.OpenAPI(info)
+		if ctx.DefaultQuery("format", "") == "yaml" {
+			ctx.YAML(http.StatusOK, doc)
+			return
+		}
+		ctx.Negotiate(http.StatusOK, []string{MIMEJSON, MIMEYAML, MIMEYAML2}, doc)
+	}
+}
+
+// SwaggerUIVersion 默认加载的 swagger-ui-dist 的版本，固定版本避免CDN上的新版本悄悄改变页面
+const SwaggerUIVersion = "5.17.14"
+
+// swaggerUIConfig Swagger UI 页面的配置
+type swaggerUIConfig struct {
+	// assets 静态资源的地址，不以 / 结尾
+	assets string
+	// cssIntegrity、jsIntegrity 静态资源的SRI哈希，为空的时候不校验
+	cssIntegrity string
+	jsIntegrity  string
+}
+
+// SwaggerUIOption Swagger UI 页面的配置项
+type SwaggerUIOption func(cfg *swaggerUIConfig)
+
+// SwaggerUIWithAssets 指定 swagger-ui-dist 静态资源的地址
+// 目录下面需要有 swagger-ui.css 和 swagger-ui-bundle.js
+func SwaggerUIWithAssets(baseURL string) SwaggerUIOption {
+	return func(cfg *swaggerUIConfig) {
+		cfg.assets = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// SwaggerUIWithIntegrity 指定静态资源的SRI哈希，例如 sha384-xxx
+// 浏览器会校验下载的文件，被篡改的时候拒绝执行
+func SwaggerUIWithIntegrity(css string, js string) SwaggerUIOption {
+	return func(cfg *swaggerUIConfig) {
+		cfg.cssIntegrity = css
+		cfg.jsIntegrity = js
+	}
+}
+
+// swaggerUITemplate Swagger UI 页面，静态资源默认从CDN加载，不需要把Swagger UI打包进来
+var swaggerUITemplate = template.Must(template.New("swagger-ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  <link rel="stylesheet" href="{{.Assets}}/swagger-ui.css"{{with .CSSIntegrity}} integrity="{{.}}"{{end}} crossorigin>
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="{{.Assets}}/swagger-ui-bundle.js"{{with .JSIntegrity}} integrity="{{.}}"{{end}} crossorigin></script>
+  <script>
+    window.onload = function () {
+      window.ui = SwaggerUIBundle({url: {{.SpecURL}}, dom_id: "#swagger-ui", deepLinking: true});
+    };
+  </script>
+</body>
+</html>
+`))
+
+// SwaggerUIHandler 展示接口文档的页面
+// title 页面标题
+// specURL 接口文档的地址，也就是OpenAPIHandler注册的路由
+func SwaggerUIHandler(title string, specURL string, opts ...SwaggerUIOption) HandleFunc {
+	cfg := &swaggerUIConfig{assets: "https://unpkg.com/swagger-ui-dist@" + SwaggerUIVersion}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	buf := &strings.Builder{}
+	err := swaggerUITemplate.Execute(buf, map[string]string{
+		"Title":        title,
+		"SpecURL":      specURL,
+		"Assets":       cfg.assets,
+		"CSSIntegrity": cfg.cssIntegrity,
+		"JSIntegrity":  cfg.jsIntegrity,
+	})
+	if err != nil {
+		panic(err)
+	}
+	page := []byte(buf.String())
+	return func(ctx *Context) {
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetHeader("Content-Type", "text/html; charset=utf-8")
+		ctx.SetData(page)
+	}
+}
+
+// openAPIMethods OpenAPI中能够表示的请求方法
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+// openAPIPathParam 路由中的一个参数
+type openAPIPathParam struct {
+	name    string
+	pattern string
+	// wildcard 通配符参数，可以包含 /
+	wildcard bool
+}
+
+// openAPIPath 把路由转换成OpenAPI的格式，同时返回路由中的参数
+func openAPIPath(pattern string) (string, []openAPIPathParam) {
+	if pattern == "/" {
+		return pattern, nil
+	}
+	parts := strings.Split(pattern[1:], "/")
+	params := make([]openAPIPathParam, 0)
+	unnamed := 0
+	for i, part := range parts {
+		var param openAPIPathParam
+		if name, expr, ok := parseRegPart(part); ok {
+			// 路由树是整段匹配的，文档里面的pattern也需要加上 ^$，不然客户端会认为 abc123 也能匹配 [0-9]+
+			param = openAPIPathParam{name: name, pattern: "^(?:" + expr + ")$"}
+		} else if strings.HasPrefix(part, ":") {
+			param = openAPIPathParam{name: part[1:]}
+		} else if strings.HasPrefix(part, "*") {
+			param = openAPIPathParam{name: part[1:], wildcard: true}
+		} else {
+			continue
+		}
+		// <expr> 这种写法没有参数名，按照出现的顺序编号
+		if param.name == "" {
+			unnamed++
+			param.name = "param" + strconv.Itoa(unnamed)
+		}
+		parts[i] = "{" + param.name + "}"
+		params = append(params, param)
+	}
+	return "/" + strings.Join(parts, "/"), params
+}
+
+// openAPIGenerator 生成接口文档的过程中需要保存的状态
+type openAPIGenerator struct {
+	// schemas 有名字的结构体
+	schemas map[string]*OpenAPISchema
+	// names 结构体类型对应的名字
+	names map[reflect.Type]string
+	// used 已经使用过的名字，不同包里面可能有同名的结构体
+	used map[string]bool
+}
+
+// operation 根据路由的元数据生成一个接口
+func (g *openAPIGenerator) operation(method string, pathParams []openAPIPathParam, info *RouteInfo) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		Summary:     info.summary,
+		Description: info.description,
+		Tags:        info.tags,
+		Deprecated:  info.deprecated,
+		Responses:   map[string]*OpenAPIResponse{},
+	}
+	fields := g.requestFields(method, info.request)
+	for _, p := range pathParams {
+		param := &OpenAPIParameter{Name: p.name, In: "path", Required: true}
+		if field, ok := fields.path[p.name]; ok {
+			param.Schema = field
+		} else {
+			param.Schema = &OpenAPISchema{Type: "string"}
+		}
+		if p.pattern != "" {
+			param.Schema.Pattern = p.pattern
+		}
+		if p.wildcard {
+			param.Description = "通配符参数，匹配剩下的全部路由，可以包含 /，OpenAPI客户端会把 / 转义成 %2F"
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+	op.Parameters = append(op.Parameters, fields.query...)
+	op.Parameters = append(op.Parameters, fields.header...)
+	if fields.body != nil {
+		content := map[string]*OpenAPIMediaType{MIMEJSON: {Schema: fields.body}}
+		if fields.form != nil {
+			content["application/x-www-form-urlencoded"] = &OpenAPIMediaType{Schema: fields.form}
+		}
+		op.RequestBody = &OpenAPIRequestBody{Required: true, Content: content}
+	}
+
+	ok := &OpenAPIResponse{Description: http.StatusText(http.StatusOK)}
+	if info.response != nil {
+		schema := g.schemaOf(info.response)
+		ok.Content = map[string]*OpenAPIMediaType{MIMEJSON: {Schema: schema}}
+		for _, format := range info.formats {
+			ok.Content[format] = &OpenAPIMediaType{Schema: schema}
+		}
+	}
+	op.Responses[strconv.Itoa(http.StatusOK)] = ok
+	// 声明了请求或者响应类型的接口，错误一般都是交给错误处理函数响应的Problem
+	if info.request != nil || info.response != nil {
+		op.Responses["default"] = &OpenAPIResponse{
+			Description: "Problem Details",
+			Content:     map[string]*OpenAPIMediaType{MIMEProblemJSON: {Schema: g.problemSchema()}},
+		}
+	}
+	return op
+}
+
+// openAPIRequest 请求类型中的字段按照位置分好类
+type openAPIRequest struct {
+	path   map[string]*OpenAPISchema
+	query  []*OpenAPIParameter
+	header []*OpenAPIParameter
+	body   *OpenAPISchema
+	form   *OpenAPISchema
+}
+
+// requestFields 按照参数绑定的规则，把请求类型中的字段分到不同的位置
+func (g *openAPIGenerator) requestFields(method string, typ reflect.Type) openAPIRequest {
+	req := openAPIRequest{path: map[string]*OpenAPISchema{}}
+	if typ == nil || indirectType(typ).Kind() != reflect.Struct {
+		return req
+	}
+	hasBody := method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+	body := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	form := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	hasForm := false
+	g.walkRequest(indirectType(typ), func(field reflect.StructField) {
+		required := isRequiredField(field)
+		if name, ok := bindingName(field, "uri"); ok {
+			req.path[name] = g.fieldSchema(field)
+			return
+		}
+		if name, ok := bindingName(field, "header"); ok {
+			req.header = append(req.header, &OpenAPIParameter{Name: name, In: "header", Required: required, Schema: g.fieldSchema(field)})
+			return
+		}
+		name, ok := bindingName(field, "query")
+		if !ok && hasBody {
+			if jsonName, skip := jsonFieldName(field); !skip {
+				addProperty(body, jsonName, g.fieldSchema(field), required)
+			}
+			if formName, ok := bindingName(field, "form"); ok {
+				hasForm = true
+				addProperty(form, formName, g.fieldSchema(field), required)
+			}
+			return
+		}
+		// 没有打标签的字段，BindQuery使用的是字段名
+		if name == "" {
+			name = field.Name
+		}
+		if name != "-" {
+			req.query = append(req.query, &OpenAPIParameter{Name: name, In: "query", Required: required, Schema: g.fieldSchema(field)})
+		}
+	})
+	if hasBody && len(body.Properties) > 0 {
+		req.body = body
+	}
+	if hasForm {
+		req.form = form
+	}
+	return req
+}
+
+// walkRequest 遍历请求类型中的字段，没有打标签的嵌入结构体和bindStruct一样继续往里面遍历
+func (g *openAPIGenerator) walkRequest(typ reflect.Type, fn func(field reflect.StructField)) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Type != timeType && field.Tag == "" {
+			g.walkRequest(field.Type, fn)
+			continue
+		}
+		fn(field)
+	}
+}
+
+// bindingName 获取字段在某个标签中的名字，第二个返回值表示有没有这个标签
+func bindingName(field reflect.StructField, tag string) (string, bool) {
+	value, ok := field.Tag.Lookup(tag)
+	if !ok {
+		return "", false
+	}
+	name, _, _ := strings.Cut(value, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// jsonFieldName 获取字段在JSON中的名字，规则和encoding/json一样
+// 第二个返回值表示这个字段不会出现在JSON中
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, false
+}
+
+// isRequiredField 字段是不是必填的，只看validate标签
+func isRequiredField(field reflect.StructField) bool {
+	for _, item := range strings.Split(field.Tag.Get("validate"), ",") {
+		if strings.TrimSpace(item) == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func addProperty(schema *OpenAPISchema, name string, property *OpenAPISchema, required bool) {
+	schema.Properties[name] = property
+	if required {
+		schema.Required = append(schema.Required, name)
+	}
+}
+
+// fieldSchema 字段的Schema，带上validate标签中的约束
+func (g *openAPIGenerator) fieldSchema(field reflect.StructField) *OpenAPISchema {
+	schema := g.schemaOf(field.Type)
+	if field.Type == durationType {
+		// 参数绑定的时候time.Duration支持 1s、5m 这种写法，JSON中是纳秒
+		schema.Description = "time.Duration"
+	}
+	applyValidateRules(schema, field.Tag.Get("validate"))
+	return schema
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schemaOf 把Go的类型转换成JSON Schema
+// 每次都返回一个新的对象，调用方可以放心修改
+func (g *openAPIGenerator) schemaOf(typ reflect.Type) *OpenAPISchema {
+	typ = indirectType(typ)
+	switch typ {
+	case timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case rawMessageType:
+		return &OpenAPISchema{}
+	}
+	// 自定义了序列化方式的类型，没办法知道序列化之后的结构
+	if typ.Kind() != reflect.Struct && reflect.PointerTo(typ).Implements(jsonMarshalerType) {
+		return &OpenAPISchema{}
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		// []byte 在JSON中是base64编码的字符串
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return &OpenAPISchema{Type: "string", Format: "byte"}
+		}
+		return &OpenAPISchema{Type: "array", Items: g.schemaOf(typ.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: g.schemaOf(typ.Elem())}
+	case reflect.Struct:
+		if typ.Name() == "" {
+			return g.structSchema(typ)
+		}
+		return &OpenAPISchema{Ref: "#/components/schemas/" + g.define(typ)}
+	default:
+		// interface{} 之类的类型，什么数据都可以
+		return &OpenAPISchema{}
+	}
+}
+
+// define 把有名字的结构体放到components中，返回使用的名字
+// 先占住名字再解析字段，结构体引用自己的时候就不会无限递归
+func (g *openAPIGenerator) define(typ reflect.Type) string {
+	if name, ok := g.names[typ]; ok {
+		return name
+	}
+	name := g.schemaName(typ)
+	g.names[typ] = name
+	g.used[name] = true
+	schema := &OpenAPISchema{}
+	g.schemas[name] = schema
+	*schema = *g.structSchema(typ)
+	return name
+}
+
+// schemaNameRegexp components中的名字只能包含这些字符
+var schemaNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// schemaName 优先使用结构体的名字，重名的时候加上包名，还是重名就加上编号
+func (g *openAPIGenerator) schemaName(typ reflect.Type) string {
+	name := strings.Trim(schemaNameRegexp.ReplaceAllString(typ.Name(), "_"), "_")
+	if !g.used[name] {
+		return name
+	}
+	pkg := typ.PkgPath()
+	if index := strings.LastIndex(pkg, "/"); index >= 0 {
+		pkg = pkg[index+1:]
+	}
+	name = schemaNameRegexp.ReplaceAllString(pkg, "_") + "." + name
+	for i, candidate := 2, name; ; i++ {
+		if !g.used[candidate] {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+}
+
+// structSchema 结构体的Schema，字段的规则和encoding/json一样
+func (g *openAPIGenerator) structSchema(typ reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	g.walkJSON(typ, schema)
+	if len(schema.Properties) == 0 {
+		schema.Properties = nil
+	}
+	return schema
+}
+
+// walkJSON 遍历结构体中会出现在JSON中的字段，没有打标签的嵌入结构体会被展开
+func (g *openAPIGenerator) walkJSON(typ reflect.Type, schema *OpenAPISchema) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			if embedded := indirectType(field.Type); embedded.Kind() == reflect.Struct {
+				g.walkJSON(embedded, schema)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		// 同一个结构体可能同时用在请求和响应中，是不是必填只看validate标签
+		addProperty(schema, name, g.fieldSchema(field), isRequiredField(field))
+	}
+}
+
+// problemSchema Problem 的Schema，扩展字段没办法提前知道
+func (g *openAPIGenerator) problemSchema() *OpenAPISchema {
+	typ := reflect.TypeOf(Problem{})
+	if name, ok := g.names[typ]; ok {
+		return &OpenAPISchema{Ref: "#/components/schemas/" + name}
+	}
+	name := g.schemaName(typ)
+	g.names[typ] = name
+	g.used[name] = true
+	g.schemas[name] = &OpenAPISchema{
+		Type: "object",
+		Properties: map[string]*OpenAPISchema{
+			"type":     {Type: "string", Format: "uri-reference"},
+			"title":    {Type: "string"},
+			"status":   {Type: "integer", Format: "int32"},
+			"detail":   {Type: "string"},
+			"instance": {Type: "string", Format: "uri-reference"},
+		},
+	}
+	return &OpenAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+// applyValidateRules 把validate标签中的规则转换成JSON Schema中的约束
+func applyValidateRules(schema *OpenAPISchema, tag string) {
+	if tag == "" || tag == "-" || schema.Ref != "" {
+		return
+	}
+	for _, item := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch name {
+		case "email":
+			schema.Format = "email"
+		case "oneof":
+			for _, option := range strings.Fields(param) {
+				schema.Enum = append(schema.Enum, enumValue(schema.Type, option))
+			}
+		case "min", "max", "len":
+			limit, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				continue
+			}
+			applyLimit(schema, name, limit)
+		}
+	}
+}
+
+// applyLimit min、max、len 对于字符串和切片限制的是长度，对于数字限制的是大小
+func applyLimit(schema *OpenAPISchema, name string, limit float64) {
+	length := int(limit)
+	switch schema.Type {
+	case "string":
+		if name != "max" {
+			schema.MinLength = &length
+		}
+		if name != "min" {
+			schema.MaxLength = &length
+		}
+	case "array":
+		if name != "max" {
+			schema.MinItems = &length
+		}
+		if name != "min" {
+			schema.MaxItems = &length
+		}
+	case "object":
+		// map 限制的是键值对的数量，minItems、maxItems 只对数组生效
+		if name != "max" {
+			schema.MinProperties = &length
+		}
+		if name != "min" {
+			schema.MaxProperties = &length
+		}
+	case "integer", "number":
+		if name == "min" {
+			schema.Minimum = &limit
+		}
+		if name == "max" {
+			schema.Maximum = &limit
+		}
+	}
+}
+
+// enumValue oneof 中的选项按照字段的类型转换，数字类型的字段枚举值也应该是数字
+func enumValue(typ string, option string) any {
+	switch typ {
+	case "integer":
+		if i, err := strconv.ParseInt(option, 10, 64); err == nil {
+			return i
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(option, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(option); err == nil {
+			return b
+		}
+	}
+	return option
+}
@@ -0,0 +1,130 @@
+package geek_web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RFC 7807 Problem Details
+
+/*
+每个项目的错误响应格式都不一样，有的是 {"code": 1, "msg": "xxx"}，有的是 {"error": "xxx"}
+RFC 7807 定义了一个通用的错误响应格式，Content-Type 是 application/problem+json
+
+	{
+		"type": "about:blank",
+		"title": "Not Found",
+		"status": 404,
+		"detail": "用户不存在",
+		"instance": "/user/15",
+		"errors": [...]
+	}
+
+	1. type		错误类型的URI，没有的时候是 about:blank，表示这个错误没有额外的含义，看status就行
+	2. title	错误类型的简短描述，同一个type的title应该是一样的
+	3. status	HTTP状态码
+	4. detail	这一次错误的具体描述
+	5. instance	出现错误的资源，一般是请求的地址
+	除此之外还可以添加任意的扩展字段，例如参数校验失败的时候，把每个字段的错误放在errors中
+
+框架默认的404、405、500以及默认的错误处理函数，在客户端能接受JSON的时候都会响应Problem
+*/
+
+// MIMEProblemJSON Problem的Content-Type
+const MIMEProblemJSON = "application/problem+json"
+
+// Problem RFC 7807 Problem Details
+// Problem 本身也是一个error，HandleFuncE 可以直接返回
+type Problem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+	// Extensions 扩展字段，序列化的时候和上面的字段平铺在一起，和上面的字段重名的会被忽略
+	Extensions map[string]any
+}
+
+// NewProblem 创建一个Problem，title 使用状态码对应的描述
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// With 添加扩展字段
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]any, 1)
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("Web: %d %s %s", p.Status, p.Title, p.Detail)
+}
+
+// MarshalJSON 扩展字段需要和标准字段平铺在一起
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	res := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		res[k] = v
+	}
+	if p.Type != "" {
+		res["type"] = p.Type
+	}
+	if p.Title != "" {
+		res["title"] = p.Title
+	}
+	if p.Status != 0 {
+		res["status"] = p.Status
+	}
+	if p.Detail != "" {
+		res["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		res["instance"] = p.Instance
+	}
+	return json.Marshal(res)
+}
+
+// Problem 响应一个Problem，状态码使用Problem中的status
+func (c *Context) Problem(p *Problem) {
+	status := p.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	bs, err := json.Marshal(p)
+	if err != nil {
+		// 扩展字段序列化失败，和JSON方法一样，交给recovery兜底
+		panic(err)
+	}
+	c.SetStatusCode(status)
+	c.SetHeader("Content-Type", MIMEProblemJSON)
+	c.SetData(bs)
+}
+
+// acceptsProblem 客户端是不是明确地表示能接受JSON
+// 没有Accept或者只有 */* 的时候【例如curl】，还是响应纯文本，不影响原来的行为
+// 客户端只接受HTML、XML、图片之类的格式的时候，协商的结果是空字符串，同样响应纯文本
+func (c *Context) acceptsProblem() bool {
+	format := c.NegotiateFormat(MIMEPlain, MIMEProblemJSON, MIMEJSON)
+	return format == MIMEProblemJSON || format == MIMEJSON
+}
+
+// problemOrText 客户端能接受JSON的时候响应Problem，否则响应纯文本
+func (c *Context) problemOrText(status int, text string) {
+	if c.acceptsProblem() {
+		p := NewProblem(status, text)
+		p.Instance = c.Pattern
+		c.Problem(p)
+		return
+	}
+	c.SetStatusCode(status)
+	c.SetData([]byte(text))
+}
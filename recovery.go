@@ -23,9 +23,8 @@ func (m *MiddlewareRecovery) Builder() Middleware {
 			// 这个defer负责hook住所有的panic错误
 			defer func() {
 				if err := recover(); err != nil {
-					// 下面的是输出给客户端看的
-					ctx.SetStatusCode(http.StatusInternalServerError)
-					ctx.SetData([]byte("Server Internal Error, Please Try Again Later!"))
+					// 下面的是输出给客户端看的，客户端能接受JSON的时候响应Problem
+					ctx.problemOrText(http.StatusInternalServerError, "Server Internal Error, Please Try Again Later!")
 					// 下面的输出给开发者看的
 					m.logFunc(m.trace(fmt.Sprintf("%s\n", err)))
 					return
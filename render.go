@@ -0,0 +1,379 @@
+package geek_web
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 响应渲染
+
+/*
+一开始Context只提供了JSON、HTML、String三种响应方式，但是实际的项目中
+	1. 有些老系统只认XML
+	2. 有些配置类的接口希望返回YAML
+	3. 有些对性能要求高的接口希望返回MessagePack
+	4. 同一个接口，不同的客户端希望拿到不同的格式【内容协商】
+
+和模板引擎一样，我们提供一个Renderer接口 + 一些内置的实现
+Renderer 按照MIME类型注册到HTTPServer上，最终也会落到Context上下文中
+内容协商的时候，根据请求头Accept选择一个格式，再找到对应的Renderer
+
+s := NewHTTPServer(ServerWithRenderer("application/x-protobuf", myProtobufRenderer))
+s.GET("/user", func(ctx *Context) {
+	ctx.Negotiate(http.StatusOK, []string{MIMEJSON, MIMEXML, MIMEYAML}, user)
+})
+*/
+
+// 常用的MIME类型
+const (
+	MIMEJSON       = "application/json"
+	MIMEXML        = "application/xml"
+	MIMEXML2       = "text/xml"
+	MIMEYAML       = "application/yaml"
+	MIMEYAML2      = "application/x-yaml"
+	MIMEMsgPack    = "application/msgpack"
+	MIMEMsgPack2   = "application/x-msgpack"
+	MIMEJavaScript = "application/javascript"
+	MIMEPlain      = "text/plain"
+)
+
+// Renderer 把数据渲染成某种格式
+type Renderer interface {
+	// ContentType 响应头中的Content-Type
+	ContentType() string
+	// Render 渲染数据
+	// ctx 上下文对象，有些格式需要用到请求中的数据，例如JSONP的callback
+	// data 需要渲染的数据
+	Render(ctx *Context, data any) ([]byte, error)
+}
+
+// JSONRenderer JSON格式，和ctx.JSON一样，HTML字符会被转义
+type JSONRenderer struct{}
+
+func (JSONRenderer) ContentType() string {
+	return MIMEJSON
+}
+
+func (JSONRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// IndentedJSONRenderer 格式化之后的JSON，方便人看，一般用在调试的时候
+type IndentedJSONRenderer struct{}
+
+func (IndentedJSONRenderer) ContentType() string {
+	return MIMEJSON
+}
+
+func (IndentedJSONRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return json.MarshalIndent(data, "", "    ")
+}
+
+// PureJSONRenderer 不会转义 <、>、& 这些HTML字符的JSON
+type PureJSONRenderer struct{}
+
+func (PureJSONRenderer) ContentType() string {
+	return MIMEJSON
+}
+
+func (PureJSONRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		return nil, err
+	}
+	// Encode 会在最后加一个换行符
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// AsciiJSONRenderer 非ASCII字符全部转义成 \uXXXX 的JSON，给只认ASCII的老客户端使用
+type AsciiJSONRenderer struct{}
+
+func (AsciiJSONRenderer) ContentType() string {
+	return MIMEJSON
+}
+
+func (AsciiJSONRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	for len(bs) > 0 {
+		r, size := utf8.DecodeRune(bs)
+		bs = bs[size:]
+		if r < utf8.RuneSelf {
+			buf.WriteByte(byte(r))
+			continue
+		}
+		// 超过0xFFFF的字符需要拆成代理对
+		if r > 0xffff {
+			r -= 0x10000
+			fmt.Fprintf(buf, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+			continue
+		}
+		fmt.Fprintf(buf, `\u%04x`, r)
+	}
+	return buf.Bytes(), nil
+}
+
+// JSONPRenderer JSONP格式，callback从查询参数callback中获取
+// 没有callback的时候就是普通的JSON
+type JSONPRenderer struct{}
+
+func (JSONPRenderer) ContentType() string {
+	return MIMEJavaScript
+}
+
+// callbackRegexp callback必须是合法的JavaScript标识符，不然就是一个XSS漏洞
+var callbackRegexp = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$.]*$`)
+
+func (JSONPRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	callback := ctx.DefaultQuery("callback", "")
+	if callback == "" {
+		return bs, nil
+	}
+	if !callbackRegexp.MatchString(callback) {
+		return nil, fmt.Errorf("Web: 非法的JSONP callback %s", callback)
+	}
+	// 前面的注释是为了防止Rosetta Flash之类的攻击
+	return []byte("/**/" + callback + "(" + string(bs) + ");"), nil
+}
+
+// XMLRenderer XML格式
+type XMLRenderer struct{}
+
+func (XMLRenderer) ContentType() string {
+	return MIMEXML
+}
+
+func (XMLRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return xml.Marshal(data)
+}
+
+// YAMLRenderer YAML格式
+type YAMLRenderer struct{}
+
+func (YAMLRenderer) ContentType() string {
+	return MIMEYAML
+}
+
+func (YAMLRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return yaml.Marshal(data)
+}
+
+// MsgPackRenderer MessagePack格式，具体的编码见msgpack.go
+type MsgPackRenderer struct{}
+
+func (MsgPackRenderer) ContentType() string {
+	return MIMEMsgPack
+}
+
+func (MsgPackRenderer) Render(ctx *Context, data any) ([]byte, error) {
+	return MarshalMsgPack(data)
+}
+
+// defaultRenderers 默认注册的Renderer
+func defaultRenderers() map[string]Renderer {
+	return map[string]Renderer{
+		MIMEJSON:     JSONRenderer{},
+		MIMEXML:      XMLRenderer{},
+		MIMEXML2:     XMLRenderer{},
+		MIMEYAML:     YAMLRenderer{},
+		MIMEYAML2:    YAMLRenderer{},
+		MIMEMsgPack:  MsgPackRenderer{},
+		MIMEMsgPack2: MsgPackRenderer{},
+	}
+}
+
+// Render 使用指定的Renderer渲染数据
+// 渲染失败直接panic，和JSON方法一样，后面有recovery兜底
+func (c *Context) Render(code int, r Renderer, data any) {
+	c.render(code, r, r.ContentType(), data)
+}
+
+// render 渲染数据，contentType 是最终写到响应头中的Content-Type
+func (c *Context) render(code int, r Renderer, contentType string, data any) {
+	bs, err := r.Render(c, data)
+	if err != nil {
+		panic(err)
+	}
+	c.SetStatusCode(code)
+	c.SetHeader("Content-Type", contentType)
+	c.SetData(bs)
+}
+
+// XML 响应XML格式数据
+func (c *Context) XML(code int, data any) {
+	c.Render(code, XMLRenderer{}, data)
+}
+
+// YAML 响应YAML格式数据
+func (c *Context) YAML(code int, data any) {
+	c.Render(code, YAMLRenderer{}, data)
+}
+
+// MsgPack 响应MessagePack格式数据
+func (c *Context) MsgPack(code int, data any) {
+	c.Render(code, MsgPackRenderer{}, data)
+}
+
+// JSONP 响应JSONP格式数据，没有callback参数的时候就是普通的JSON
+func (c *Context) JSONP(code int, data any) {
+	if c.DefaultQuery("callback", "") == "" {
+		c.Render(code, JSONRenderer{}, data)
+		return
+	}
+	c.Render(code, JSONPRenderer{}, data)
+}
+
+// PureJSON 响应JSON格式数据，不转义HTML字符
+func (c *Context) PureJSON(code int, data any) {
+	c.Render(code, PureJSONRenderer{}, data)
+}
+
+// IndentedJSON 响应格式化之后的JSON数据
+func (c *Context) IndentedJSON(code int, data any) {
+	c.Render(code, IndentedJSONRenderer{}, data)
+}
+
+// AsciiJSON 响应只包含ASCII字符的JSON数据
+func (c *Context) AsciiJSON(code int, data any) {
+	c.Render(code, AsciiJSONRenderer{}, data)
+}
+
+// Negotiate 内容协商，根据请求头Accept从offers中选择一个格式响应
+// offers 服务端支持的MIME类型，按照优先级排序，每个MIME类型都必须注册了Renderer
+// 客户端能接受的格式一个都没有的时候，响应406
+func (c *Context) Negotiate(code int, offers []string, data any) {
+	// 同一个地址会根据Accept返回不同的内容，必须告诉缓存
+	c.AddHeader("Vary", "Accept")
+	format := c.NegotiateFormat(offers...)
+	if format == "" {
+		c.problemOrText(http.StatusNotAcceptable, "406 NOT ACCEPTABLE")
+		return
+	}
+	r, ok := c.renderer(format)
+	if !ok {
+		panic(fmt.Sprintf("Web: 没有注册 %s 的Renderer", format))
+	}
+	c.render(code, r, negotiatedContentType(format, r.ContentType()), data)
+}
+
+// negotiatedContentType 内容协商之后的Content-Type
+// 同一个Renderer可能注册在多个MIME类型上，例如 application/yaml 和 application/x-yaml
+// 响应的必须是客户端要的那个，Renderer 自己带的参数【例如charset】保留下来
+func negotiatedContentType(format string, rendererContentType string) string {
+	_, params, err := mime.ParseMediaType(rendererContentType)
+	if err != nil || len(params) == 0 {
+		return format
+	}
+	if contentType := mime.FormatMediaType(format, params); contentType != "" {
+		return contentType
+	}
+	return format
+}
+
+// NegotiateFormat 根据请求头Accept从offers中选择一个格式，都不能接受的时候返回空字符串
+// 1. 没有Accept请求头的时候，选择第一个
+// 2. q值越大越优先，q=0 表示不能接受
+// 3. q值一样的时候，按照offers的顺序
+func (c *Context) NegotiateFormat(offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	accept := c.Request.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+	specs := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(specs, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// renderer 根据MIME类型找到Renderer
+func (c *Context) renderer(mimeType string) (Renderer, bool) {
+	renderers := c.renderers
+	if renderers == nil {
+		renderers = defaultRenderers()
+	}
+	r, ok := renderers[mimeType]
+	return r, ok
+}
+
+// acceptSpec Accept请求头中的一项，例如 text/html;q=0.8
+type acceptSpec struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// parseAccept 解析Accept请求头，按照具体程度从高到低排序
+// text/html > text/* > */*
+func parseAccept(accept string) []acceptSpec {
+	specs := make([]acceptSpec, 0, 4)
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		specs = append(specs, acceptSpec{typ: typ, subtype: subtype, q: q})
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].specificity() > specs[j].specificity()
+	})
+	return specs
+}
+
+func (s acceptSpec) specificity() int {
+	switch {
+	case s.typ == "*":
+		return 0
+	case s.subtype == "*":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// acceptQuality 计算offer的q值，使用最具体的那一项
+func acceptQuality(specs []acceptSpec, offer string) float64 {
+	typ, subtype, _ := strings.Cut(offer, "/")
+	for _, spec := range specs {
+		if (spec.typ == "*" || spec.typ == typ) && (spec.subtype == "*" || spec.subtype == subtype) {
+			return spec.q
+		}
+	}
+	return 0
+}
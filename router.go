@@ -1,6 +1,9 @@
 package geek_web
 
 import (
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -19,7 +22,9 @@ func newRouter() *router {
 }
 
 // addRouter 注册路由
-func (r *router) addRouter(method string, pattern string, handleFunc HandleFunc) {
+// middlewares 是只作用在这条路由上的中间件，会和视图函数一起保存到节点上
+// 返回注册好的节点，方便调用方在节点上补充其他信息
+func (r *router) addRouter(method string, pattern string, handleFunc HandleFunc, middlewares ...Middleware) *node {
 	// 校验 pattern的相关信息
 	// 1. 不能为空
 	if pattern == "" {
@@ -51,7 +56,8 @@ func (r *router) addRouter(method string, pattern string, handleFunc HandleFunc)
 			panic("Web: 路由冲突")
 		}
 		root.handler = handleFunc
-		return
+		root.middlewares = middlewares
+		return root
 	}
 
 	// 切割 pattern
@@ -73,6 +79,8 @@ func (r *router) addRouter(method string, pattern string, handleFunc HandleFunc)
 		panic("Web: 路有冲突")
 	}
 	root.handler = handleFunc
+	root.middlewares = middlewares
+	return root
 }
 
 // findRouter 匹配路由
@@ -132,8 +140,12 @@ func (r *router) findRouter(method string, pattern string) (*node, map[string]st
 		//	params[root.starChild.part[1:]] = pattern[index:]
 		//	return root.starChild, params, true
 		//}
-		if pOk { // 是否是参数匹配 :和*匹配
-			if strings.HasPrefix(root.part, ":") { // 处理参数路由
+		if pOk { // 是否是参数匹配 :、正则和*匹配
+			if root.regExpr != nil { // 处理正则路由，只有 :name(expr) 这种写法才需要记录参数
+				if root.paramName != "" {
+					params[root.paramName] = part
+				}
+			} else if strings.HasPrefix(root.part, ":") { // 处理参数路由
 				params[root.part[1:]] = part
 			} else if strings.HasPrefix(root.part, "*") { // 处理通配符路由
 				index := strings.Index(pattern, part)
@@ -162,10 +174,73 @@ func (r *router) findRouter(method string, pattern string) (*node, map[string]st
 	return root, params, root.handler != nil
 }
 
+// allowedMethods 查找除了method之外，还有哪些请求方法的路由树上注册了pattern
+// 主要是用来区分404和405两种情况，返回的请求方法是排好序的，方便直接设置到Allow响应头中
+func (r *router) allowedMethods(method string, pattern string) []string {
+	methods := make([]string, 0, len(r.trees))
+	for m := range r.trees {
+		if m == method {
+			continue
+		}
+		if n, _, ok := r.findRouter(m, pattern); ok && n.handler != nil {
+			methods = append(methods, m)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// route 路由树上注册过的一个路由
+type route struct {
+	method  string
+	pattern string
+	node    *node
+}
+
+// routes 遍历路由树，返回全部注册过的路由，按照路由和请求方法排好序
+func (r *router) routes() []route {
+	routes := make([]route, 0)
+	for method, root := range r.trees {
+		routes = root.walk(method, "", routes)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].pattern != routes[j].pattern {
+			return routes[i].pattern < routes[j].pattern
+		}
+		return routes[i].method < routes[j].method
+	})
+	return routes
+}
+
+// walk 深度优先遍历节点，prefix 是父节点的完整路由
+func (n *node) walk(method string, prefix string, routes []route) []route {
+	pattern := prefix + "/" + n.part
+	if prefix == "" && n.part == "/" {
+		// 根节点
+		pattern, prefix = "/", ""
+	} else {
+		prefix = pattern
+	}
+	if n.handler != nil {
+		routes = append(routes, route{method: method, pattern: pattern, node: n})
+	}
+	for _, child := range n.children {
+		routes = child.walk(method, prefix, routes)
+	}
+	for _, child := range []*node{n.paramChild, n.regChild, n.starChild} {
+		if child != nil {
+			routes = child.walk(method, prefix, routes)
+		}
+	}
+	return routes
+}
+
 // node 树上节点的结构
 // 匹配顺序
 // 1. 静态匹配
-// 2. 通配符匹配
+// 2. 参数匹配
+// 3. 正则匹配
+// 4. 通配符匹配
 type node struct {
 	// part 单块的路径
 	// /user/login => [user, login]
@@ -180,51 +255,82 @@ type node struct {
 	// 改正：不是只有叶子节点才会有这个属性，/user和/user/login这两个都有这个属性，这两个路由也都是合法的
 	handler HandleFunc
 
+	// middlewares 只作用在这条路由上的中间件，在注册路由的时候就已经确定好了
+	// 和handler一样，不是只有叶子节点才会有这个属性
+	middlewares []Middleware
+
+	// group 注册这条路由的路由组，组装调用链的时候通过它找到路由组上的中间件
+	// 组装好的调用链：框架内部的中间件 + 路由组的中间件 + middlewares + handler
+	group *RouterGroup
+
+	// info 路由的元数据，生成接口文档的时候使用，和handler一样只有注册过的节点才会有
+	info *RouteInfo
+
 	// 通配符 * 表达的节点，任意匹配
 	starChild *node
 
 	// 参数 : 匹配
 	paramChild *node
+
+	// 正则匹配，两种写法
+	// 1. /orders/:id(^[0-9]+$) 命中之后会把数据记录到参数 id 中
+	// 2. /files/<[a-z]+\.pdf> 只做校验，不记录参数
+	regChild *node
+
+	// regExpr 正则节点上编译好的正则表达式，只有正则节点才会有这个属性
+	regExpr *regexp.Regexp
+
+	// paramName 正则节点需要记录的参数名，<expr> 写法的正则节点这个属性为空
+	paramName string
 }
 
 // childOf 用于匹配节点
 // 查找节点，判断当前的节点的子节点中有没有path节点
-// 优先级：精确匹配 > :匹配 > *匹配
+// 优先级：精确匹配 > :匹配 > 正则匹配 > *匹配
 // 第一个返回值是匹配到的节点
-// 第二个返回值是控制是否是参数匹配：: 和 * 匹配
+// 第二个返回值是控制是否是参数匹配：:、正则和 * 匹配
 // 第三个返回值是控制是否匹配到节点
 func (n *node) childOf(part string) (*node, bool, bool) {
-	if n.children == nil {
-		// 如果精确匹配没有匹配到，先用 : 节点匹配，再用 * 节点匹配
-		if n.paramChild != nil {
-			return n.paramChild, true, n.paramChild != nil
-		}
-		// 如果精确匹配没有匹配到，就用 * 匹配
-		return n.starChild, true, n.starChild != nil
-	}
 	// 因为这里是查找，所以不存在当前节点的children属性是nil的情况
 	// 只有一种情况会是这样，就是叶子节点
-	child, ok := n.children[part]
-	if !ok {
-		// 如果精确匹配没有匹配到，先用 : 节点匹配，再用 * 节点匹配
-		if n.paramChild != nil {
-			return n.paramChild, true, n.paramChild != nil
+	if n.children != nil {
+		if child, ok := n.children[part]; ok {
+			return child, false, ok
 		}
-		// 如果精确匹配没有匹配到，就用 * 匹配
-		return n.starChild, true, n.starChild != nil
 	}
-	return child, false, ok
+	// 如果精确匹配没有匹配到，先用 : 节点匹配
+	if n.paramChild != nil {
+		return n.paramChild, true, true
+	}
+	// 再用正则节点匹配，正则没有命中的话不能直接返回失败，还得交给下一个优先级的 * 节点
+	if n.regChild != nil && n.regChild.regExpr.MatchString(part) {
+		return n.regChild, true, true
+	}
+	// 最后就用 * 匹配
+	return n.starChild, true, n.starChild != nil
 }
 
 // childOrCreate 用于注册路由使用
 // 查找节点，判断当前节点的子节点中是否存在path节点，已存在返回path节点，不存在就创建节点并添加到子节点中
 func (n *node) childOrCreate(part string) (*node, bool) {
+	if paramName, expr, ok := parseRegPart(part); ok {
+		// 是正则的情况
+		if n.regChild == nil { // 多判断一层，如果regChild不是nil，就表示之前这个路由被注册过了
+			reg, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", expr))
+			if err != nil {
+				panic(fmt.Sprintf("Web: 非法的正则路由 %s", part))
+			}
+			n.regChild = &node{part: part, regExpr: reg, paramName: paramName}
+		}
+		// 同一个位置上只能有一个正则表达式，并且参数节点和正则节点不能共存，不然正则节点永远都匹配不上
+		return n.regChild, n.regChild.part == part && n.paramChild == nil
+	}
 	if strings.HasPrefix(part, ":") {
 		// 是参数 : 的情况
 		if n.paramChild == nil { // 多判断一层，如果paramChild不是nil，就表示之前这个路由被注册过了
 			n.paramChild = &node{part: part}
 		}
-		return n.paramChild, n.starChild == nil
+		return n.paramChild, n.starChild == nil && n.regChild == nil
 	}
 	if strings.HasPrefix(part, "*") {
 		// 是通配符 * 的情况
@@ -249,6 +355,23 @@ func (n *node) childOrCreate(part string) (*node, bool) {
 	return child, true
 }
 
+// parseRegPart 解析正则路由的单块路径
+// :id(^[0-9]+$) => id, ^[0-9]+$, true
+// <[a-z]+\.pdf> => "", [a-z]+\.pdf, true
+// 第三个返回值表示part是不是正则路由
+func parseRegPart(part string) (string, string, bool) {
+	if len(part) > 2 && strings.HasPrefix(part, "<") && strings.HasSuffix(part, ">") {
+		return "", part[1 : len(part)-1], true
+	}
+	if strings.HasPrefix(part, ":") && strings.HasSuffix(part, ")") {
+		index := strings.Index(part, "(")
+		if index > 1 && index < len(part)-2 {
+			return part[1:index], part[index+1 : len(part)-1], true
+		}
+	}
+	return "", "", false
+}
+
 // bug修复
 // 1. 修复参数路由也会贪婪匹配
 // 2. 解决一个路由同层级上，同时注册
@@ -264,8 +387,10 @@ func (n *node) childOrCreate(part string) (*node, bool) {
 	- 对于通配符路由，我们需要注意，它是贪婪匹配的，所以一旦命中，他会直接返回命中的节点，并且也会保存请求地址上携带的参数
 	接下来我们需要支持正则路由
 	正则路由的优先级是在参数路由之下，通配符路由之上的，并且它的处理逻辑和参数路由相似
-- TODO 正则路由
-	1. 格式：/user/<*.?>
+- 正则路由
+	1. 格式：/user/<.*?> 或者 /orders/:id(^[0-9]+$)
 	2. 优先级：低于参数路由，高于通配符路由
-	3. 特殊处理：无需地址上的携带的数据
+	3. 特殊处理：<expr> 写法无需地址上的携带的数据，:name(expr) 写法会把数据记录到参数中
+	4. 正则没有命中的时候，会继续交给通配符路由匹配，而不是直接返回失败
+	5. 正则表达式会整段匹配，也就是说 <[0-9]+> 不会匹配上 abc123
 */
@@ -10,9 +10,10 @@ func TestAddRouter(t *testing.T) {
 	mockHandler := func(ctx *Context) {}
 
 	testRouter := []struct {
-		name    string
-		method  string
-		pattern string
+		name      string
+		method    string
+		pattern   string
+		wantPanic bool
 	}{
 		{
 
@@ -41,28 +42,36 @@ func TestAddRouter(t *testing.T) {
 			pattern: "/",
 		},
 		{
-			name:    "错误 GET //user/home",
-			method:  "GET",
-			pattern: "//user/home",
+			name:      "错误 GET //user/home",
+			method:    "GET",
+			pattern:   "//user/home",
+			wantPanic: true,
 		},
 		{
-			name:    "错误 GET book/info",
-			method:  "GET",
-			pattern: "book/info",
+			name:      "错误 GET book/info",
+			method:    "GET",
+			pattern:   "book/info",
+			wantPanic: true,
 		},
 		{
-			name:    "错误 GET /hero/id/",
-			method:  "GET",
-			pattern: "/hero/id/",
+			name:      "错误 GET /hero/id/",
+			method:    "GET",
+			pattern:   "/hero/id/",
+			wantPanic: true,
 		},
 	}
 
 	r := newRouter()
 	for _, tt := range testRouter {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				assert.Panics(t, func() {
+					r.addRouter(tt.method, tt.pattern, mockHandler)
+				})
+				return
+			}
 			r.addRouter(tt.method, tt.pattern, mockHandler)
 		})
-		// r.addRouter(tt.method, tt.pattern, mockHandler)
 	}
 }
 
@@ -88,12 +97,11 @@ func TestStarAddRouter(t *testing.T) {
 	}
 
 	r := newRouter()
-	for _, tt := range testRouter {
-		//t.Run(tt.name, func(t *testing.T) {
-		//	r.addRouter(tt.method, tt.pattern, mockHandler)
-		//})
-		r.addRouter(tt.method, tt.pattern, mockHandler)
-	}
+	r.addRouter(testRouter[0].method, testRouter[0].pattern, mockHandler)
+	// 同一个位置已经有通配符路由了，不能再注册参数路由
+	assert.Panics(t, func() {
+		r.addRouter(testRouter[1].method, testRouter[1].pattern, mockHandler)
+	})
 	t.Log(r)
 }
 
@@ -276,3 +284,207 @@ func TestRegFindRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestRegFallthroughFindRouter(t *testing.T) {
+	mockHandler := func(ctx *Context) {}
+
+	testRouter := []struct {
+		name    string
+		method  string
+		pattern string
+	}{
+		{
+			name:    "测试 GET /orders/:id(^[0-9]+$)",
+			method:  "GET",
+			pattern: "/orders/:id(^[0-9]+$)",
+		},
+		{
+			name:    "测试 GET /orders/*action",
+			method:  "GET",
+			pattern: "/orders/*action",
+		},
+		{
+			name:    "测试 GET /files/<[a-z]+\\.pdf>",
+			method:  "GET",
+			pattern: "/files/<[a-z]+\\.pdf>",
+		},
+	}
+
+	r := newRouter()
+	for _, tt := range testRouter {
+		r.addRouter(tt.method, tt.pattern, mockHandler)
+	}
+
+	wantRouter := []struct {
+		name       string
+		method     string
+		pattern    string
+		wantOk     bool
+		wantPart   string
+		wantParams map[string]string
+	}{
+		{
+			name:       "命中正则 /orders/15",
+			method:     "GET",
+			pattern:    "/orders/15",
+			wantOk:     true,
+			wantPart:   ":id(^[0-9]+$)",
+			wantParams: map[string]string{"id": "15"},
+		},
+		{
+			name:       "正则未命中交给通配符 /orders/latest",
+			method:     "GET",
+			pattern:    "/orders/latest",
+			wantOk:     true,
+			wantPart:   "*action",
+			wantParams: map[string]string{"action": "latest"},
+		},
+		{
+			name:       "命中正则 /files/report.pdf",
+			method:     "GET",
+			pattern:    "/files/report.pdf",
+			wantOk:     true,
+			wantPart:   "<[a-z]+\\.pdf>",
+			wantParams: map[string]string{},
+		},
+		{
+			name:    "正则整段匹配 /files/report.pdf.exe",
+			method:  "GET",
+			pattern: "/files/report.pdf.exe",
+			wantOk:  false,
+		},
+	}
+	for _, wr := range wantRouter {
+		t.Run(wr.name, func(t *testing.T) {
+			n, params, ok := r.findRouter(wr.method, wr.pattern)
+			assert.Equal(t, wr.wantOk, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, wr.wantPart, n.part)
+			assert.Equal(t, wr.wantParams, params)
+		})
+	}
+}
+
+func TestRegConflictAddRouter(t *testing.T) {
+	mockHandler := func(ctx *Context) {}
+
+	r := newRouter()
+	r.addRouter("GET", "/orders/:id(^[0-9]+$)", mockHandler)
+	assert.Panics(t, func() {
+		r.addRouter("GET", "/orders/:name", mockHandler)
+	})
+	assert.Panics(t, func() {
+		r.addRouter("GET", "/orders/<[a-z]+>", mockHandler)
+	})
+	assert.Panics(t, func() {
+		r.addRouter("GET", "/users/<[a-z+>", mockHandler)
+	})
+}
+
+func TestNestedGroupAddRouter(t *testing.T) {
+	mockHandler := func(ctx *Context) {}
+
+	s := NewHTTPServer()
+	api := s.Group("/api")
+	v1 := api.Group("/v1/")
+	users := v1.Group("users")
+	admin := users.Group("/admin")
+	same := admin.Group("/")
+	{
+		api.GET("/ping", mockHandler)
+		v1.GET("/ping", mockHandler)
+		users.GET("/:id", mockHandler)
+		admin.POST("/login", mockHandler)
+		same.GET("/stats", mockHandler)
+	}
+
+	wantRouter := []struct {
+		name    string
+		method  string
+		pattern string
+		wantOk  bool
+	}{
+		{
+			name:    "一层嵌套 GET /api/ping",
+			method:  "GET",
+			pattern: "/api/ping",
+			wantOk:  true,
+		},
+		{
+			name:    "两层嵌套 GET /api/v1/ping",
+			method:  "GET",
+			pattern: "/api/v1/ping",
+			wantOk:  true,
+		},
+		{
+			name:    "三层嵌套 GET /api/v1/users/15",
+			method:  "GET",
+			pattern: "/api/v1/users/15",
+			wantOk:  true,
+		},
+		{
+			name:    "四层嵌套 POST /api/v1/users/admin/login",
+			method:  "POST",
+			pattern: "/api/v1/users/admin/login",
+			wantOk:  true,
+		},
+		{
+			name:    "空前缀嵌套 GET /api/v1/users/admin/stats",
+			method:  "GET",
+			pattern: "/api/v1/users/admin/stats",
+			wantOk:  true,
+		},
+		{
+			name:    "没有继承父路由组前缀 GET /v1/ping",
+			method:  "GET",
+			pattern: "/v1/ping",
+			wantOk:  false,
+		},
+		{
+			name:    "没有继承父路由组前缀 POST /admin/login",
+			method:  "POST",
+			pattern: "/admin/login",
+			wantOk:  false,
+		},
+	}
+	for _, wr := range wantRouter {
+		t.Run(wr.name, func(t *testing.T) {
+			_, _, ok := s.router.findRouter(wr.method, wr.pattern)
+			assert.Equal(t, wr.wantOk, ok)
+		})
+	}
+	assert.Equal(t, "/api/v1/users/admin", same.prefix)
+}
+
+func TestRouterRoutes(t *testing.T) {
+	mockHandler := func(ctx *Context) {}
+	r := newRouter()
+	r.addRouter("GET", "/", mockHandler)
+	r.addRouter("GET", "/user", mockHandler)
+	r.addRouter("POST", "/user/:id", mockHandler)
+	r.addRouter("GET", "/user/:id/detail", mockHandler)
+	r.addRouter("GET", "/assets/*filepath", mockHandler)
+	r.addRouter("GET", "/files/<[a-z]+\\.pdf>/<[0-9]+>", mockHandler)
+
+	routes := make([]string, 0)
+	for _, rt := range r.routes() {
+		routes = append(routes, rt.method+" "+rt.pattern)
+	}
+	assert.Equal(t, []string{
+		"GET /",
+		"GET /assets/*filepath",
+		"GET /files/<[a-z]+\\.pdf>/<[0-9]+>",
+		"GET /user",
+		"POST /user/:id",
+		"GET /user/:id/detail",
+	}, routes)
+
+	path, params := openAPIPath("/files/<[a-z]+\\.pdf>/<[0-9]+>")
+	assert.Equal(t, "/files/{param1}/{param2}", path)
+	assert.Equal(t, []openAPIPathParam{{name: "param1", pattern: "^(?:[a-z]+\\.pdf)$"}, {name: "param2", pattern: "^(?:[0-9]+)$"}}, params)
+	path, params = openAPIPath("/")
+	assert.Equal(t, "/", path)
+	assert.Empty(t, params)
+}
@@ -1,10 +1,21 @@
 package geek_web
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // HandleFunc 视图函数的唯一签名
@@ -23,12 +34,21 @@ type Server interface {
 	// Start 作为Server启动的入口
 	Start(addr string) error
 
+	// StartTLS 作为HTTPS Server启动的入口
+	// certFile、keyFile 证书和私钥文件，如果通过ServerWithTLSConfig配置好了证书，这里可以传空字符串
+	StartTLS(addr string, certFile string, keyFile string) error
+
+	// Shutdown 优雅退出，等待正在处理的请求全部处理完之后再关闭Server
+	Shutdown(ctx context.Context) error
+
 	// AddRouter 注册路由的唯一方法
 	// method 请求方法
 	// path URL 路径，必须以 / 开头
-	// handlerFunc 视图函数
+	// handleFunc 视图函数，HandleFuncE需要先通过WithError转换
+	// middlewares 只作用在这条路由上的中间件，在路由组的中间件之后执行
+	// 返回路由的元数据，可以继续补充接口文档需要的信息
 	// 这是内部核心的API，没必要暴露出去，所以改成小写
-	addRouter(method string, path string, handleFunc HandleFunc)
+	addRouter(method string, path string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo
 }
 
 // HTTPServer 实现一个HTTP协议的Server接口
@@ -40,8 +60,72 @@ type HTTPServer struct {
 	// 我们思考一下，这个模板渲染的功能是所有的用户都需要的吗？或者说，至少大部分用户都需要用到？
 	// 其实不是的，这个功能对很多用户来说并不需要，所以我们这里可以做一个优化处理，对于有需求的用户，需要额外再做一些配置，对HTTPServer对象
 	templateEngine TemplateEngine
+
+	// notFoundHandler 路由没有命中时执行的视图函数
+	notFoundHandler HandleFunc
+	// methodNotAllowedHandler 路由在其他请求方法的路由树上存在，但是当前请求方法没有注册时执行的视图函数
+	methodNotAllowedHandler HandleFunc
+
+	// internalMiddlewares 框架内部的中间件，只需要初始化一次
+	internalMiddlewares []Middleware
+
+	// chainsMu 保护调用链的组装
+	chainsMu sync.Mutex
+	// compiled 组装好的调用链【*chainSet】，Use或者注册路由之后会被清空，处理下一个请求的时候重新组装
+	compiled atomic.Value
+
+	// pool 复用Context，减少每个请求的内存分配
+	pool sync.Pool
+
+	// validator 参数校验器，和模板引擎一样，最终会落到Context上下文中
+	validator Validator
+
+	// maxMultipartMemory 解析multipart/form-data的时候，最多使用多少内存，超过的部分会写入临时文件
+	maxMultipartMemory int64
+
+	// renderers 按照MIME类型注册的Renderer，和模板引擎一样，最终会落到Context上下文中
+	renderers map[string]Renderer
+
+	// errorHandler 错误处理函数，HandleFuncE返回的error都会交给它处理
+	errorHandler ErrorHandler
+
+	// mu 保护server属性，Start和Shutdown一般是在不同的goroutine中调用的
+	mu sync.Mutex
+	// server 真正监听端口的http.Server，我们自己持有它才能做到优雅退出
+	server *http.Server
+	// closed 是否已经调用过Shutdown，避免Shutdown先于Start执行的时候，服务还是被启动了
+	closed bool
+	// onStart 启动之前需要执行的钩子
+	onStart []Hook
+	// onShutdown 退出之后需要执行的钩子，例如session的存储、日志需要刷盘
+	onShutdown []Hook
+	// shutdownTimeout Run方法收到退出信号之后，最多等待多长时间
+	shutdownTimeout time.Duration
+
+	// tlsConfig HTTPS的配置
+	tlsConfig *tls.Config
+	// redirectAddr HTTP重定向到HTTPS的监听地址，为空表示不开启重定向
+	redirectAddr string
+	// redirectServer 负责HTTP重定向到HTTPS的http.Server
+	redirectServer *http.Server
+	// redirectListener 重定向服务的监听器，启动失败的时候需要马上释放端口
+	redirectListener net.Listener
+
+	// 下面这些都是直接交给http.Server的配置，零值表示不限制
+	// 生产环境一定要配置，不然很容易被慢连接攻击【slowloris】把连接耗尽
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	// listener 用户自定义的监听器，配置了之后Start和StartTLS的addr参数就不再生效了
+	listener net.Listener
 }
 
+// Hook 生命周期的钩子函数
+type Hook func(ctx context.Context) error
+
 // ServerOption 抽象一个可配置的类型
 type ServerOption func(server *HTTPServer)
 
@@ -54,6 +138,126 @@ func ServerWithTemplateEngine(t TemplateEngine) ServerOption {
 	}
 }
 
+// ServerWithValidator 替换默认的参数校验器，想使用其他校验库的用户实现Validator接口即可
+func ServerWithValidator(v Validator) ServerOption {
+	return func(server *HTTPServer) {
+		server.validator = v
+	}
+}
+
+// ServerWithRenderer 注册Renderer，已经注册过的MIME类型会被覆盖
+// 内置了JSON、XML、YAML、MessagePack，想要支持其他格式【例如Protobuf】的用户实现Renderer接口即可
+func ServerWithRenderer(mimeType string, r Renderer) ServerOption {
+	return func(server *HTTPServer) {
+		server.renderers[mimeType] = r
+	}
+}
+
+// ServerWithMaxMultipartMemory 解析multipart/form-data的时候，最多使用多少内存，超过的部分会写入临时文件
+// 注意：这个不是限制上传文件的大小，限制上传文件的大小请使用MaxUploadSize中间件
+func ServerWithMaxMultipartMemory(size int64) ServerOption {
+	return func(server *HTTPServer) {
+		server.maxMultipartMemory = size
+	}
+}
+
+// ServerWithNotFoundHandler 自定义路由没有命中时的视图函数
+// 这个视图函数一样会经过路由组上的中间件，执行之前状态码已经被设置成了404
+func ServerWithNotFoundHandler(handleFunc HandleFunc) ServerOption {
+	return func(server *HTTPServer) {
+		server.notFoundHandler = handleFunc
+	}
+}
+
+// ServerWithMethodNotAllowedHandler 自定义请求方法不被允许时的视图函数
+// 这个视图函数一样会经过路由组上的中间件，执行之前状态码已经被设置成了405，Allow响应头也已经设置好了
+func ServerWithMethodNotAllowedHandler(handleFunc HandleFunc) ServerOption {
+	return func(server *HTTPServer) {
+		server.methodNotAllowedHandler = handleFunc
+	}
+}
+
+// ServerWithOnStart 注册启动之前需要执行的钩子，按照注册的顺序执行，有一个出错Server就不会启动
+func ServerWithOnStart(hooks ...Hook) ServerOption {
+	return func(server *HTTPServer) {
+		server.onStart = append(server.onStart, hooks...)
+	}
+}
+
+// ServerWithOnShutdown 注册退出之后需要执行的钩子，按照注册的顺序执行
+// 钩子是在正在处理的请求全部处理完之后才执行的，所以这里可以放心地刷新session的存储、日志等数据
+func ServerWithOnShutdown(hooks ...Hook) ServerOption {
+	return func(server *HTTPServer) {
+		server.onShutdown = append(server.onShutdown, hooks...)
+	}
+}
+
+// ServerWithShutdownTimeout 设置Run方法收到退出信号之后，最多等待多长时间
+func ServerWithShutdownTimeout(timeout time.Duration) ServerOption {
+	return func(server *HTTPServer) {
+		server.shutdownTimeout = timeout
+	}
+}
+
+// ServerWithTLSConfig 配置HTTPS，例如最低的TLS版本、加密套件、证书等
+func ServerWithTLSConfig(config *tls.Config) ServerOption {
+	return func(server *HTTPServer) {
+		server.tlsConfig = config
+	}
+}
+
+// ServerWithHTTPSRedirect 通过StartTLS启动的时候，额外在addr上监听HTTP请求，并且全部重定向到HTTPS
+// 一般是 :80 重定向到 :443
+func ServerWithHTTPSRedirect(addr string) ServerOption {
+	return func(server *HTTPServer) {
+		server.redirectAddr = addr
+	}
+}
+
+// ServerWithReadTimeout 读取整个请求【包括请求体】的超时时间
+func ServerWithReadTimeout(timeout time.Duration) ServerOption {
+	return func(server *HTTPServer) {
+		server.readTimeout = timeout
+	}
+}
+
+// ServerWithReadHeaderTimeout 读取请求头的超时时间，防止慢连接攻击最重要的就是这个配置
+func ServerWithReadHeaderTimeout(timeout time.Duration) ServerOption {
+	return func(server *HTTPServer) {
+		server.readHeaderTimeout = timeout
+	}
+}
+
+// ServerWithWriteTimeout 写响应的超时时间
+// 注意：流式响应、长轮询这种需要长时间写数据的场景，这个时间要设置得足够长
+func ServerWithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(server *HTTPServer) {
+		server.writeTimeout = timeout
+	}
+}
+
+// ServerWithIdleTimeout keep-alive的连接最多空闲多长时间
+func ServerWithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(server *HTTPServer) {
+		server.idleTimeout = timeout
+	}
+}
+
+// ServerWithMaxHeaderBytes 请求头最大的字节数
+func ServerWithMaxHeaderBytes(size int) ServerOption {
+	return func(server *HTTPServer) {
+		server.maxHeaderBytes = size
+	}
+}
+
+// ServerWithListener 使用自定义的监听器，例如Unix Domain Socket、systemd传过来的监听器
+// 配置之后Start和StartTLS的addr参数就不再生效了
+func ServerWithListener(l net.Listener) ServerOption {
+	return func(server *HTTPServer) {
+		server.listener = l
+	}
+}
+
 // 这条语句没有任何实际作用，只是为了在语法层面上能够保证HTTPServer结构体实现了Server接口
 var _ Server = &HTTPServer{}
 
@@ -76,77 +280,360 @@ var _ Server = &HTTPServer{}
 
 // ServeHTTP  向前对接客户端请求，向后对接Web框架
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// 1. 构建上下文
-	ctx := newContext(w, r)
+	// 1. 构建上下文，从池子里面拿一个Context，用完之后再放回去
+	ctx := s.pool.Get().(*Context)
+	ctx.reset(w, r)
+	defer s.pool.Put(ctx)
 	// 将HTTPServer中的TemplateEngine对象转给Context上下文对象
 	ctx.t = s.templateEngine
+	ctx.validator = s.validator
+	ctx.maxMultipartMemory = s.maxMultipartMemory
+	ctx.renderers = s.renderers
+	ctx.errorHandler = s.errorHandler
 	log.Printf("REQUEST COMING %4s - %s", ctx.Method, ctx.Pattern)
 	// 2. 匹配路由
 	n, params, ok := s.findRouter(ctx.Method, ctx.Pattern)
-	if !ok || n.handler == nil {
-		// 下面的逻辑目前是直接写数据到响应体中，并且直接返回到客户端
-		// 不太好，因为这种方式没有执行框架内部中间件和用户中间件
-		//w.WriteHeader(http.StatusNotFound)
-		//_, _ = w.Write([]byte("404 NOT FOUND"))
-		//return
-
-		// 优化: 主要思路就是将n【匹配到的路由节点】篡改掉，具体是改handler方法
-		n = &node{handler: func(ctx *Context) {
-			ctx.SetStatusCode(http.StatusNotFound)
-			ctx.SetData([]byte("404 NOT FOUND"))
-			return
-		}}
+	if (!ok || n.handler == nil) && ctx.Method == http.MethodHead {
+		// HEAD 请求没有单独注册的话，直接使用GET请求的视图函数，响应体会在刷新数据的时候丢弃掉
+		n, params, ok = s.findRouter(http.MethodGet, ctx.Pattern)
 	}
 	// 保存请求地址上的参数到上下文中
 	ctx.params = params
-	// 匹配路由组 ---> 获取中间件
-	middlewares := s.filterGroup(ctx.Pattern)
-	if middlewares == nil {
-		middlewares = make([]Middleware, 0)
-	}
-	// 重点：将命中的视图函数添加到中间件列表中，统一执行
-	// 必须倒序组装，只有这样，最后出来的handler才会是第一个注册的中间件
-	// handler其实一直在变
+	// 3. 执行调用链
+	// 命中的路由在第一次处理请求的时候就已经把中间件、框架内部的中间件和视图函数组装好了，这里直接执行就行
 	// 具体原理参考文章：https://juejin.cn/post/7227139379105038392
-	handler := n.handler
-	for i := len(middlewares) - 1; i >= 0; i-- {
-		handler = middlewares[i](handler) // 第一次执行的时候，handler其实还是用户的业务视图
+	if ok && n.handler != nil {
+		s.chains().routes[n](ctx)
+		return
 	}
+	// 下面的逻辑目前是直接写数据到响应体中，并且直接返回到客户端
+	// 不太好，因为这种方式没有执行框架内部中间件和用户中间件
+	//w.WriteHeader(http.StatusNotFound)
+	//_, _ = w.Write([]byte("404 NOT FOUND"))
+	//return
+
+	// 优化: 没有命中的路由不存在绑定好的调用链，只能通过请求地址去匹配路由组，使用路由组组装好的调用链
+	// 再进一步: 如果这个路由在其他请求方法的路由树上存在，就应该返回405，并且告诉客户端哪些请求方法是允许的
+	fallback := s.chains().fallbacks[s.filterGroup(ctx.Pattern)]
+	// OPTIONS 请求没有单独注册的话，框架自动根据注册过的请求方法响应
+	if methods := s.router.allowedMethods(ctx.Method, ctx.Pattern); len(methods) > 0 {
+		ctx.SetHeader("Allow", allowHeader(methods))
+		if ctx.Method == http.MethodOptions {
+			ctx.SetStatusCode(http.StatusNoContent)
+			fallback.options(ctx)
+			return
+		}
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		fallback.methodNotAllowed(ctx)
+		return
+	}
+	ctx.SetStatusCode(http.StatusNotFound)
+	fallback.notFound(ctx)
+}
 
-	// 没执行下面的方法之前，handler是用户注册的第一个中间件函数
-	// 执行下面的方法之后，handler就是框架内部注册的第一个中间件函数
+// Start 启动服务
+// 调用Shutdown之后，Start会返回nil，而不是http.ErrServerClosed
+// addr 支持 unix:/path/to/web.sock 这种写法，监听Unix Domain Socket
+func (s *HTTPServer) Start(addr string) error {
+	return s.start(addr, func(server *http.Server, l net.Listener) error {
+		return server.Serve(l)
+	})
+}
 
-	// 这里统一注册框架内部的中间件
-	handler = s.registerMiddlewares(handler) // registerMiddlewares方法必须是将用户的中间件注册完之后才能注册框架内部的中间件逻辑
-	// 具体执行全部的中间件
-	handler(ctx) // 此时handler已经变了
+// StartTLS 启动HTTPS服务
+// 如果配置了ServerWithHTTPSRedirect，还会额外启动一个把HTTP请求重定向到HTTPS的服务
+// HTTPS服务启动失败【例如证书错误】的时候，重定向的服务也会一起关掉
+func (s *HTTPServer) StartTLS(addr string, certFile string, keyFile string) error {
+	if addr == "" {
+		addr = ":https"
+	}
+	return s.start(addr, func(server *http.Server, l net.Listener) error {
+		if s.redirectAddr != "" {
+			if err := s.startRedirect(l.Addr().String()); err != nil {
+				return err
+			}
+		}
+		err := server.ServeTLS(l, certFile, keyFile)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.closeRedirect()
+		}
+		return err
+	})
+}
 
-	//// 具体执行中间件方法
-	//handler(ctx) // 此时handler是用户注册的第一个中间件
+// start 启动服务的公共逻辑
+// serve 具体怎么提供服务，HTTP和HTTPS的区别就在这里
+func (s *HTTPServer) start(addr string, serve func(server *http.Server, l net.Listener) error) error {
+	// 1. 执行启动之前的钩子
+	for _, hook := range s.onStart {
+		if err := hook(context.Background()); err != nil {
+			return err
+		}
+	}
+	// 2. 启动服务，将HTTPServer作为IO多路复用器
+	// 不能直接使用http.ListenAndServe，因为我们需要持有http.Server，才能做到优雅退出
+	server := s.buildServer(addr)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.server = server
+	s.mu.Unlock()
+	l, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+	err = serve(server, l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	// 证书加载失败之类的错误，ServeTLS不会关闭监听器
+	_ = l.Close()
+	return err
+}
 
-	// 3. 执行命中路由的视图函数
-	// n.handler(ctx)
-	// 4. 统一返回响应
-	// _ = ctx.Resp()
+// Shutdown 优雅退出
+// 1. 不再接收新的请求，等待正在处理的请求全部处理完
+// 2. 执行退出之后的钩子，钩子出错也不会中断，返回第一个错误
+// ctx 控制最多等待多长时间
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	server, redirectServer := s.server, s.redirectServer
+	s.closed = true
+	s.mu.Unlock()
+	var err error
+	if redirectServer != nil {
+		err = redirectServer.Shutdown(ctx)
+	}
+	if server != nil {
+		if serverErr := server.Shutdown(ctx); serverErr != nil && err == nil {
+			err = serverErr
+		}
+	}
+	for _, hook := range s.onShutdown {
+		if hookErr := hook(ctx); hookErr != nil && err == nil {
+			err = hookErr
+		}
+	}
+	return err
 }
 
-func (s *HTTPServer) Start(addr string) error {
-	// 直接使用内置方法启动一个服务，将HTTPServer作为IO多路复用器
-	return http.ListenAndServe(addr, s)
+// Run 启动服务，并且在收到退出信号之后优雅退出
+// signals 默认是SIGINT和SIGTERM，部署的时候一般就是这两个信号
+func (s *HTTPServer) Run(addr string, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, signals...)
+	defer signal.Stop(quit)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(addr)
+	}()
+	select {
+	case err := <-errCh:
+		// 启动失败，或者是其他地方调用了Shutdown
+		return err
+	case sig := <-quit:
+		log.Printf("RECEIVE SIGNAL %s, SHUTTING DOWN...", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	return <-errCh
 }
 
-func (s *HTTPServer) filterGroup(pattern string) []Middleware {
-	for _, group := range s.groups {
-		if strings.HasPrefix(pattern, group.prefix) {
-			return group.middlewares
+// buildServer 创建真正监听端口的http.Server
+func (s *HTTPServer) buildServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		TLSConfig:         s.tlsConfig,
+		ReadTimeout:       s.readTimeout,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+	}
+}
+
+// listen 监听端口
+// 1. 配置了自定义的监听器，直接使用
+// 2. unix:/path/to/web.sock 监听Unix Domain Socket
+// 3. 其他的都当作TCP地址
+func (s *HTTPServer) listen(addr string) (net.Listener, error) {
+	if s.listener != nil {
+		return s.listener, nil
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// 上次进程异常退出的时候，socket文件可能没有被删除，导致监听失败
+		// 只删除socket文件，避免误删用户的普通文件
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(path); err != nil {
+				return nil, err
+			}
 		}
+		return net.Listen("unix", path)
+	}
+	if addr == "" {
+		addr = ":http"
 	}
+	return net.Listen("tcp", addr)
+}
+
+// startRedirect 启动把HTTP请求重定向到HTTPS的服务
+// tlsAddr HTTPS服务的监听地址，重定向的时候需要用到它的端口
+func (s *HTTPServer) startRedirect(tlsAddr string) error {
+	_, port, err := net.SplitHostPort(tlsAddr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.redirectAddr)
+	if err != nil {
+		return err
+	}
+	// 超时时间、请求头大小这些限制和HTTPS服务一样，HTTP端口一样会被慢连接攻击
+	redirectServer := s.buildServer(s.redirectAddr)
+	redirectServer.Handler = redirectHandler(port)
+	redirectServer.TLSConfig = nil
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.redirectServer, s.redirectListener = redirectServer, l
+	s.mu.Unlock()
+	go func() {
+		if err := redirectServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTPS REDIRECT SERVER ERROR %s", err)
+		}
+	}()
 	return nil
 }
 
+// closeRedirect 关闭重定向到HTTPS的服务，HTTPS服务启动失败的时候不能让它一直留着
+func (s *HTTPServer) closeRedirect() {
+	s.mu.Lock()
+	redirectServer, l := s.redirectServer, s.redirectListener
+	s.redirectServer, s.redirectListener = nil, nil
+	s.mu.Unlock()
+	if redirectServer != nil {
+		_ = redirectServer.Close()
+		// Serve 在另外一个goroutine中执行，可能还没来得及接管监听器，这里直接关掉
+		_ = l.Close()
+	}
+}
+
+// redirectHandler 把HTTP请求重定向到HTTPS
+// GET和HEAD用301，其他的请求方法用308，308能够保证客户端重定向之后还是用原来的请求方法和请求体
+func redirectHandler(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	}
+}
+
+// filterGroup 匹配路由组
+// 1. 按照路径段匹配，规则和路由树一样，/v1 不会匹配到 /v1beta/user，/user/:id 可以匹配到 /user/42/x
+// 2. 有多个路由组匹配上的时候，选择路径段最多的那个，路径段一样多的时候选择嵌套最深的那个
+// 3. 一个路由组都没有匹配上的时候，使用根路由组
+func (s *HTTPServer) filterGroup(pattern string) *RouterGroup {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	target, depth := s.RouterGroup, 0
+	for _, group := range s.groups {
+		if len(group.parts) < len(target.parts) || !group.matchPrefix(parts) {
+			continue
+		}
+		// s.Group("/") 和父路由组是同一个前缀，只能通过嵌套的深度区分
+		if d := group.depth(); len(group.parts) > len(target.parts) || d > depth {
+			target, depth = group, d
+		}
+	}
+	return target
+}
+
+// chainSet 组装好的全部调用链，组装好之后就不会再修改，所以请求之间可以放心共用
+type chainSet struct {
+	// routes 每个路由节点对应的调用链
+	routes map[*node]HandleFunc
+	// fallbacks 每个路由组没有命中路由时的调用链
+	fallbacks map[*RouterGroup]*fallback
+}
+
+// chains 获取组装好的调用链
+// 注册路由的时候不能直接组装，因为之后还可能Use新的中间件，所以推迟到处理请求的时候再组装
+// 只有第一个请求或者Use、注册路由之后的第一个请求才需要组装，其他的请求直接使用缓存
+func (s *HTTPServer) chains() *chainSet {
+	if cs, _ := s.compiled.Load().(*chainSet); cs != nil {
+		return cs
+	}
+	s.chainsMu.Lock()
+	defer s.chainsMu.Unlock()
+	// 拿到锁之后再检查一次，其他的请求可能已经组装好了
+	if cs, _ := s.compiled.Load().(*chainSet); cs != nil {
+		return cs
+	}
+	cs := &chainSet{routes: map[*node]HandleFunc{}, fallbacks: map[*RouterGroup]*fallback{}}
+	for _, r := range s.router.routes() {
+		middlewares := r.node.middlewares
+		if r.node.group != nil {
+			middlewares = append(r.node.group.chain(), middlewares...)
+		}
+		cs.routes[r.node] = s.compile(r.node.handler, middlewares)
+	}
+	// 没有命中路由的时候执行路由组上的中间件，路由组的数量不多，直接全部组装好
+	for _, group := range append([]*RouterGroup{s.RouterGroup}, s.groups...) {
+		middlewares := group.chain()
+		cs.fallbacks[group] = &fallback{
+			notFound:         s.compile(s.notFoundHandler, middlewares),
+			methodNotAllowed: s.compile(s.methodNotAllowedHandler, middlewares),
+			options:          s.compile(defaultOptionsHandler, middlewares),
+		}
+	}
+	s.compiled.Store(cs)
+	return cs
+}
+
+// resetChains 清空组装好的调用链，Use、注册路由或者创建路由组之后调用
+func (s *HTTPServer) resetChains() {
+	s.chainsMu.Lock()
+	defer s.chainsMu.Unlock()
+	s.compiled.Store((*chainSet)(nil))
+}
+
+// compile 把中间件和视图函数组装成一条完整的调用链
+// 必须倒序组装，只有这样，最后出来的handler才会是第一个注册的中间件
+// 调用链只需要组装一次，之后每个请求过来直接执行就行，不需要每次都重新组装，参考chains
+func (s *HTTPServer) compile(handleFunc HandleFunc, middlewares []Middleware) HandleFunc {
+	handler := handleFunc
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler) // 第一次执行的时候，handler其实还是用户的业务视图
+	}
+	// 没执行下面的方法之前，handler是用户注册的第一个中间件函数
+	// 执行下面的方法之后，handler就是框架内部注册的第一个中间件函数
+	return s.registerMiddlewares(handler) // registerMiddlewares方法必须是将用户的中间件注册完之后才能注册框架内部的中间件逻辑
+}
+
 // registerMiddlewares 注册框架内部的中间件
+// 框架内部的中间件在创建HTTPServer的时候就初始化好了，不需要每次都重新创建
 func (s *HTTPServer) registerMiddlewares(handler HandleFunc) HandleFunc {
-	for _, middleware := range s.initInternalMiddlewares() {
+	for _, middleware := range s.internalMiddlewares {
 		handler = middleware(handler)
 	}
 	return handler
@@ -197,18 +684,77 @@ func NewHTTPServer(opts ...ServerOption) *HTTPServer {
 	r := newRouter()
 	group := newRouterGroup()
 	engine := &HTTPServer{
-		router:      r,
-		RouterGroup: group,
-		groups:      []*RouterGroup{},
+		router:                  r,
+		RouterGroup:             group,
+		groups:                  []*RouterGroup{},
+		notFoundHandler:         defaultNotFoundHandler,
+		methodNotAllowedHandler: defaultMethodNotAllowedHandler,
+		shutdownTimeout:         10 * time.Second,
+		validator:               defaultValidator,
+		maxMultipartMemory:      defaultMultipartMemory,
+		renderers:               defaultRenderers(),
+		errorHandler:            DefaultErrorHandler,
 	}
 	group.engine = engine
 	// 通过这个就能做成一个可配置的HTTPServer了
 	for _, opt := range opts {
 		opt(engine)
 	}
+	// 框架内部的中间件可能会依赖上面的配置项，所以放在配置项之后初始化
+	engine.internalMiddlewares = engine.initInternalMiddlewares()
+	engine.pool.New = func() any {
+		return &Context{header: http.Header{}}
+	}
 	return engine
 }
 
+// defaultNotFoundHandler 默认的404视图函数，客户端能接受JSON的时候响应Problem
+func defaultNotFoundHandler(ctx *Context) {
+	ctx.problemOrText(http.StatusNotFound, "404 NOT FOUND")
+}
+
+// defaultMethodNotAllowedHandler 默认的405视图函数，客户端能接受JSON的时候响应Problem
+func defaultMethodNotAllowedHandler(ctx *Context) {
+	ctx.problemOrText(http.StatusMethodNotAllowed, "405 METHOD NOT ALLOWED")
+}
+
+// defaultOptionsHandler 自动响应OPTIONS请求的视图函数，Allow响应头在执行之前已经设置好了
+func defaultOptionsHandler(ctx *Context) {
+	ctx.SetStatusCode(http.StatusNoContent)
+}
+
+// allowHeader 组装Allow响应头
+// 除了注册过的请求方法，框架自动支持的HEAD【注册了GET】和OPTIONS也需要告诉客户端
+func allowHeader(methods []string) string {
+	allows := make([]string, 0, len(methods)+2)
+	hasGet, hasHead, hasOptions := false, false, false
+	for _, method := range methods {
+		switch method {
+		case http.MethodGet:
+			hasGet = true
+		case http.MethodHead:
+			hasHead = true
+		case http.MethodOptions:
+			hasOptions = true
+		}
+		allows = append(allows, method)
+	}
+	if hasGet && !hasHead {
+		allows = append(allows, http.MethodHead)
+	}
+	if !hasOptions {
+		allows = append(allows, http.MethodOptions)
+	}
+	sort.Strings(allows)
+	return strings.Join(allows, ", ")
+}
+
+// anyMethods Any方法会注册的全部请求方法
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodHead,
+	http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace,
+}
+
 /*
 - 思考：
 	1. 路由分组怎么实现？
@@ -232,33 +778,97 @@ func NewHTTPServer(opts ...ServerOption) *HTTPServer {
 
 type RouterGroup struct {
 	prefix      string       // 路由分组前缀
+	parts       []*node      // 路由分组前缀的每一段，匹配的规则和路由树一样，根路由组没有
 	parent      *RouterGroup // 父路由组
 	engine      *HTTPServer  // server实例对象, 这样写有点不太优雅，因为这里应该是一个接口的，这样直接写成HTTPServer耦合性太高
-	middlewares []Middleware // 全部的中间件。注意，这里的middlewares是保存着当前路由组这条线上所有的中间件
+	middlewares []Middleware // 当前路由组自己的中间件。注意，父路由组的中间件是通过parent找到的，不会保存在这里
 }
 
-func (g *RouterGroup) GET(pattern string, handleFunc HandleFunc) {
-	g.addRouter(http.MethodGet, pattern, handleFunc)
+// fallback 没有命中路由时需要执行的调用链
+type fallback struct {
+	notFound         HandleFunc // 404
+	methodNotAllowed HandleFunc // 405
+	options          HandleFunc // 自动响应的OPTIONS
 }
 
-func (g *RouterGroup) POST(pattern string, handleFunc HandleFunc) {
-	g.addRouter(http.MethodPost, pattern, handleFunc)
+// GET 注册GET请求的路由
+// 返回error的视图函数需要通过WithError转换，返回的error会统一交给ServerWithErrorHandler配置的错误处理函数
+// 返回的RouteInfo可以继续补充接口文档需要的信息，不需要的话直接忽略就行
+// s.GET("/user/:id", handler).Summary("获取用户信息").Tags("user")
+func (g *RouterGroup) GET(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodGet, pattern, handleFunc, middlewares...)
 }
 
-func (g *RouterGroup) DELETE(pattern string, handleFunc HandleFunc) {
-	g.addRouter(http.MethodDelete, pattern, handleFunc)
+func (g *RouterGroup) POST(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodPost, pattern, handleFunc, middlewares...)
 }
 
-func (g *RouterGroup) PUT(pattern string, handleFunc HandleFunc) {
-	g.addRouter(http.MethodPut, pattern, handleFunc)
+func (g *RouterGroup) DELETE(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodDelete, pattern, handleFunc, middlewares...)
+}
+
+func (g *RouterGroup) PUT(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodPut, pattern, handleFunc, middlewares...)
+}
+
+func (g *RouterGroup) PATCH(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodPatch, pattern, handleFunc, middlewares...)
+}
+
+// HEAD 一般不需要注册，没有注册的时候框架会使用GET请求的视图函数，并丢弃响应体
+func (g *RouterGroup) HEAD(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodHead, pattern, handleFunc, middlewares...)
+}
+
+// OPTIONS 一般不需要注册，没有注册的时候框架会根据注册过的请求方法自动响应
+func (g *RouterGroup) OPTIONS(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.addRouter(http.MethodOptions, pattern, handleFunc, middlewares...)
+}
+
+// Any 给全部的请求方法都注册上同一个视图函数，全部的请求方法共用同一个RouteInfo
+func (g *RouterGroup) Any(pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	info := &RouteInfo{}
+	for _, method := range anyMethods {
+		g.handle(method, pattern, handleFunc, info, middlewares)
+	}
+	return info
+}
+
+// Handle 注册任意请求方法的路由，自定义的请求方法也可以通过这个方法注册
+func (g *RouterGroup) Handle(method string, pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	if method == "" {
+		panic("Web: 请求方法不能是空字符串")
+	}
+	return g.addRouter(method, pattern, handleFunc, middlewares...)
 }
 
 // addRouter 注册路由
 // 唯一和路由树做交互的通道
-func (g *RouterGroup) addRouter(method string, pattern string, handleFunc HandleFunc) {
+// handleFunc 视图函数，返回error的视图函数通过WithError转换，Typed返回的本身就是HandleFunc
+// 路由组上的中间件是在处理请求的时候才组装到路由上的，所以Use和注册路由的先后顺序没有关系
+// middlewares 只作用在这条路由上的中间件，在路由组这条线上的中间件之后执行
+// g.GET("/admin/stats", handler, authMW, rateLimitMW)
+func (g *RouterGroup) addRouter(method string, pattern string, handleFunc HandleFunc, middlewares ...Middleware) *RouteInfo {
+	return g.handle(method, pattern, handleFunc, &RouteInfo{}, middlewares)
+}
+
+// handle 注册路由，并把路由的元数据保存到节点上
+// Typed 返回的视图函数，请求和响应的类型直接作为元数据的默认值
+func (g *RouterGroup) handle(method string, pattern string, handleFunc HandleFunc, info *RouteInfo, middlewares []Middleware) *RouteInfo {
+	if handleFunc == nil {
+		panic("Web: 视图函数不能为nil")
+	}
 	pattern = fmt.Sprintf("%s%s", g.prefix, pattern)
-	g.engine.router.addRouter(method, pattern, handleFunc)
+	n := g.engine.router.addRouter(method, pattern, handleFunc, middlewares...)
+	// 路由组上的中间件在组装调用链的时候再通过group找到，这样注册路由之后再Use的中间件也能生效
+	n.group = g
+	g.engine.resetChains()
+	if typed, ok := TypedInfoOf(handleFunc); ok {
+		info.request, info.response, info.formats = typed.Request, typed.Response, typed.Formats
+	}
+	n.info = info
 	log.Printf("REGISTER ROUTER %4s - %s", method, pattern)
+	return info
 }
 
 // findRouter 匹配路由
@@ -271,26 +881,90 @@ func (g *RouterGroup) findRouter(method string, pattern string) (*node, map[stri
 // Group 创建路由分组
 // 1. 创建一个新的路由分组
 // 2. 将新的路由分组添加到路由组中央（server的groups属性中）
+// 路由分组是可以嵌套的，新的路由分组的前缀是在父路由组的前缀后面拼接的
+// s.Group("/api").Group("/v1") => /api/v1
 func (g *RouterGroup) Group(prefix string) *RouterGroup {
-	prefix = fmt.Sprintf("/%s", strings.Trim(prefix, "/"))
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		// s.Group("/") 这种情况和父路由组是同一个前缀
+		prefix = g.prefix
+	} else {
+		prefix = fmt.Sprintf("%s/%s", g.prefix, prefix)
+	}
 	newGroup := &RouterGroup{
-		prefix:      prefix,
-		parent:      g,
-		engine:      g.engine,
-		middlewares: g.middlewares,
+		prefix: prefix,
+		parent: g,
+		engine: g.engine,
+	}
+	if prefix != "" {
+		// 借用路由树的节点解析每一段前缀，正则也是在这里编译好的
+		for _, part := range strings.Split(prefix[1:], "/") {
+			n, _ := (&node{}).childOrCreate(part)
+			newGroup.parts = append(newGroup.parts, n)
+		}
 	}
 	g.engine.groups = append(g.engine.groups, newGroup)
+	g.engine.resetChains()
 	return newGroup
 }
 
 // Use 注册中间件
-// 将中间件保存在路由组中
+// 将中间件保存在路由组中，会作用到当前路由组和子路由组的全部路由上，不管这些路由是在Use之前还是之后注册的
+// 中间件的执行顺序只和Use的顺序、路由组的嵌套有关系：父路由组的中间件 > 子路由组的中间件 > 路由自己的中间件
+// 注意：Use 需要在启动服务之前调用，服务运行的过程中修改中间件是不安全的
 func (g *RouterGroup) Use(middlewares ...Middleware) {
 	if g.middlewares == nil {
 		g.middlewares = middlewares
-		return
+	} else {
+		g.middlewares = append(g.middlewares, middlewares...)
+	}
+	g.engine.resetChains()
+}
+
+// matchPrefix 判断请求地址的路径段是不是在当前路由组下面
+// 静态的段需要完全一样，:name 匹配任意一段，正则整段匹配，*name 匹配剩下的全部
+func (g *RouterGroup) matchPrefix(parts []string) bool {
+	for i, n := range g.parts {
+		if i >= len(parts) || parts[i] == "" {
+			return false
+		}
+		switch {
+		case n.regExpr != nil:
+			if !n.regExpr.MatchString(parts[i]) {
+				return false
+			}
+		case strings.HasPrefix(n.part, ":"):
+		case strings.HasPrefix(n.part, "*"):
+			return true
+		case n.part != parts[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// depth 路由组嵌套的深度，根路由组是0
+func (g *RouterGroup) depth() int {
+	depth := 0
+	for group := g.parent; group != nil; group = group.parent {
+		depth++
 	}
-	g.middlewares = append(g.middlewares, middlewares...)
+	return depth
+}
+
+// chain 获取当前路由组这条线上的全部中间件
+// 从根路由组开始，一直到当前路由组，顺序就是中间件的执行顺序
+// 每次都是返回一个新的切片，避免不同的路由之间共用同一个底层数组
+func (g *RouterGroup) chain() []Middleware {
+	groups := make([]*RouterGroup, 0)
+	for group := g; group != nil; group = group.parent {
+		groups = append(groups, group)
+	}
+	middlewares := make([]Middleware, 0)
+	for i := len(groups) - 1; i >= 0; i-- {
+		middlewares = append(middlewares, groups[i].middlewares...)
+	}
+	return middlewares
 }
 
 func newRouterGroup() *RouterGroup {
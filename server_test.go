@@ -1,18 +1,36 @@
-package geek_web
+package geek_web_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	geek_web "github.com/borntodie-new/geek-web"
 	"github.com/borntodie-new/geek-web/middleware/accesslog"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestServer(t *testing.T) {
-	s := NewHTTPServer()
+	s := geek_web.NewHTTPServer()
 	// 我们注册一个全局的中间件
-	s.Use(func(next HandleFunc) HandleFunc {
-		return func(ctx *Context) {
+	s.Use(func(next geek_web.HandleFunc) geek_web.HandleFunc {
+		return func(ctx *geek_web.Context) {
 			ctime := time.Now()
 			time.Sleep(time.Microsecond * 2)
 			next(ctx)
@@ -25,33 +43,33 @@ func TestServer(t *testing.T) {
 	// 给v1注册日志记录中间件
 	v1.Use(builder.Builder())
 	{
-		v1.GET("/user", func(ctx *Context) {
-			ctx.JSON(http.StatusOK, H{
+		v1.GET("/user", func(ctx *geek_web.Context) {
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"method": ctx.Method,
 			})
 		})
-		v1.GET("/user/login", func(ctx *Context) {
-			ctx.JSON(http.StatusOK, H{
+		v1.GET("/user/login", func(ctx *geek_web.Context) {
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"method": ctx.Method,
 			})
 		})
-		v1.GET("/assets/*filepath", func(ctx *Context) {
+		v1.GET("/assets/*filepath", func(ctx *geek_web.Context) {
 			filePath, _ := ctx.Param("filepath")
-			ctx.JSON(http.StatusOK, H{
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"info":   "你是想访问我的这个文件吗？【" + filePath + "]",
 				"method": ctx.Method,
 			})
 		})
-		v1.GET("/user/:id/:action", func(ctx *Context) {
+		v1.GET("/user/:id/:action", func(ctx *geek_web.Context) {
 			id, _ := ctx.Param("id")
 			action, _ := ctx.Param("action")
-			ctx.JSON(http.StatusOK, H{
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"id":     id,
@@ -62,33 +80,33 @@ func TestServer(t *testing.T) {
 	}
 	v2 := s.Group("/v2")
 	{
-		v2.POST("/user", func(ctx *Context) {
-			ctx.JSON(http.StatusOK, H{
+		v2.POST("/user", func(ctx *geek_web.Context) {
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"method": ctx.Method,
 			})
 		})
-		v2.POST("/user/login", func(ctx *Context) {
-			ctx.JSON(http.StatusOK, H{
+		v2.POST("/user/login", func(ctx *geek_web.Context) {
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"method": ctx.Method,
 			})
 		})
-		v2.POST("/assets/*filepath", func(ctx *Context) {
+		v2.POST("/assets/*filepath", func(ctx *geek_web.Context) {
 			filePath, _ := ctx.Param("filepath")
-			ctx.JSON(http.StatusOK, H{
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"info":   "你是想访问我的这个文件吗？【" + filePath + "]",
 				"method": ctx.Method,
 			})
 		})
-		v2.POST("/user/:id/:action", func(ctx *Context) {
+		v2.POST("/user/:id/:action", func(ctx *geek_web.Context) {
 			id, _ := ctx.Param("id")
 			action, _ := ctx.Param("action")
-			ctx.JSON(http.StatusOK, H{
+			ctx.JSON(http.StatusOK, geek_web.H{
 				"code":   200,
 				"msg":    "请求成功" + ctx.Pattern,
 				"id":     id,
@@ -97,5 +115,1256 @@ func TestServer(t *testing.T) {
 			})
 		})
 	}
-	_ = s.Start(":8080")
+	// 不监听端口，直接把请求交给ServeHTTP
+	testCases := []struct {
+		name       string
+		method     string
+		url        string
+		wantCode   int
+		wantParams map[string]string
+	}{
+		{name: "静态路由", method: http.MethodGet, url: "/v1/user", wantCode: http.StatusOK},
+		{
+			name: "通配符路由", method: http.MethodGet, url: "/v1/assets/css/main.css", wantCode: http.StatusOK,
+			wantParams: map[string]string{"info": "你是想访问我的这个文件吗？【css/main.css]"},
+		},
+		{
+			name: "参数路由", method: http.MethodPost, url: "/v2/user/15/edit", wantCode: http.StatusOK,
+			wantParams: map[string]string{"id": "15", "action": "edit"},
+		},
+		{name: "请求方法不一致", method: http.MethodPost, url: "/v1/user", wantCode: http.StatusMethodNotAllowed},
+		{name: "路由不存在", method: http.MethodGet, url: "/v3/user", wantCode: http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.url, nil))
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			body := map[string]any{}
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+			assert.Equal(t, "请求成功"+tc.url, body["msg"])
+			assert.Equal(t, tc.method, body["method"])
+			for key, val := range tc.wantParams {
+				assert.Equal(t, val, body[key])
+			}
+		})
+	}
+}
+
+func TestServerMethodNotAllowed(t *testing.T) {
+	s := geek_web.NewHTTPServer()
+	mockHandler := func(ctx *geek_web.Context) {}
+	s.GET("/user/:id", mockHandler)
+	s.PUT("/user/:id", mockHandler)
+	s.POST("/user", mockHandler)
+
+	testCases := []struct {
+		name       string
+		method     string
+		pattern    string
+		wantStatus int
+		wantAllow  string
+	}{
+		{
+			name:       "命中路由",
+			method:     http.MethodGet,
+			pattern:    "/user/15",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "请求方法不被允许",
+			method:     http.MethodDelete,
+			pattern:    "/user/15",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD, OPTIONS, PUT",
+		},
+		{
+			name:       "路由不存在",
+			method:     http.MethodDelete,
+			pattern:    "/order/15",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.pattern, nil))
+			assert.Equal(t, tc.wantStatus, recorder.Code)
+			assert.Equal(t, tc.wantAllow, recorder.Header().Get("Allow"))
+		})
+	}
+}
+
+func TestServerCustomNotFoundHandler(t *testing.T) {
+	s := geek_web.NewHTTPServer(
+		geek_web.ServerWithNotFoundHandler(func(ctx *geek_web.Context) {
+			ctx.String(http.StatusNotFound, []byte("custom not found"))
+		}),
+		geek_web.ServerWithMethodNotAllowedHandler(func(ctx *geek_web.Context) {
+			ctx.SetData([]byte("custom method not allowed"))
+		}),
+	)
+	v1 := s.Group("/v1")
+	v1.Use(func(next geek_web.HandleFunc) geek_web.HandleFunc {
+		return func(ctx *geek_web.Context) {
+			ctx.SetHeader("X-Middleware", "v1")
+			next(ctx)
+		}
+	})
+	v1.GET("/user", func(ctx *geek_web.Context) {})
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/order", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "custom not found", recorder.Body.String())
+	assert.Equal(t, "v1", recorder.Header().Get("X-Middleware"))
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/user", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", recorder.Header().Get("Allow"))
+	assert.Equal(t, "custom method not allowed", recorder.Body.String())
+}
+
+func TestServerHeadAndOptions(t *testing.T) {
+	s := geek_web.NewHTTPServer()
+	s.GET("/user", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte("hello"))
+	})
+	s.PATCH("/user", func(ctx *geek_web.Context) {})
+	s.Handle("PURGE", "/cache", func(ctx *geek_web.Context) {})
+	s.Any("/any", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte(ctx.Method))
+	})
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/user", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "5", recorder.Header().Get("Content-Length"))
+	assert.Equal(t, "", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, "/user", nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS, PATCH", recorder.Header().Get("Allow"))
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest("PURGE", "/cache", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, "/order", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodTrace, "/any", nil))
+	assert.Equal(t, http.MethodTrace, recorder.Body.String())
+}
+
+func TestServerMiddlewareChain(t *testing.T) {
+	var trace []string
+	mockMiddleware := func(name string) geek_web.Middleware {
+		return func(next geek_web.HandleFunc) geek_web.HandleFunc {
+			return func(ctx *geek_web.Context) {
+				trace = append(trace, name)
+				next(ctx)
+			}
+		}
+	}
+	mockHandler := func(ctx *geek_web.Context) {}
+
+	s := geek_web.NewHTTPServer()
+	s.Use(mockMiddleware("root"))
+	s.GET("/ping", mockHandler)
+	v1 := s.Group("/v1")
+	v1.Use(mockMiddleware("v1"))
+	v1.GET("/user", mockHandler)
+	v1beta := s.Group("/v1beta")
+	v1beta.GET("/user", mockHandler)
+	admin := v1.Group("/admin")
+	admin.Use(mockMiddleware("admin"))
+	admin.GET("/stats", mockHandler)
+	user := s.Group("/user/:id")
+	user.Use(mockMiddleware("user"))
+	user.GET("/profile", mockHandler)
+	order := s.Group("/order/:oid(^[0-9]+$)")
+	order.Use(mockMiddleware("order"))
+	order.GET("/detail", mockHandler)
+	v1same := v1.Group("/")
+	v1same.Use(mockMiddleware("v1same"))
+	v1same.GET("/ping", mockHandler)
+	// 路由注册之后再注册的中间件，也会作用到已经注册的路由上
+	v1beta.Use(mockMiddleware("v1beta"))
+
+	testCases := []struct {
+		name      string
+		method    string
+		pattern   string
+		wantTrace []string
+	}{
+		{
+			name:      "没有分组的路由也会执行根路由组的中间件",
+			method:    http.MethodGet,
+			pattern:   "/ping",
+			wantTrace: []string{"root"},
+		},
+		{
+			name:      "路由组中间件",
+			method:    http.MethodGet,
+			pattern:   "/v1/user",
+			wantTrace: []string{"root", "v1"},
+		},
+		{
+			name:      "前缀相似的路由组之间中间件相互隔离",
+			method:    http.MethodGet,
+			pattern:   "/v1beta/user",
+			wantTrace: []string{"root", "v1beta"},
+		},
+		{
+			name:      "嵌套路由组中间件按照从外到内的顺序执行",
+			method:    http.MethodGet,
+			pattern:   "/v1/admin/stats",
+			wantTrace: []string{"root", "v1", "admin"},
+		},
+		{
+			name:      "404 按照路径段匹配路由组",
+			method:    http.MethodGet,
+			pattern:   "/v1/admin/unknown",
+			wantTrace: []string{"root", "v1", "admin"},
+		},
+		{
+			name:      "404 前缀相似的路由组不会匹配",
+			method:    http.MethodGet,
+			pattern:   "/v1admin",
+			wantTrace: []string{"root"},
+		},
+		{
+			name:      "404 参数路由组",
+			method:    http.MethodGet,
+			pattern:   "/user/42/x",
+			wantTrace: []string{"root", "user"},
+		},
+		{
+			name:      "405 参数路由组",
+			method:    http.MethodPost,
+			pattern:   "/user/42/profile",
+			wantTrace: []string{"root", "user"},
+		},
+		{
+			name:      "404 正则路由组",
+			method:    http.MethodGet,
+			pattern:   "/order/12/x",
+			wantTrace: []string{"root", "order"},
+		},
+		{
+			name:      "404 正则没有命中的路由组不会匹配",
+			method:    http.MethodGet,
+			pattern:   "/order/abc/x",
+			wantTrace: []string{"root"},
+		},
+		{
+			name:      "404 Group(\"/\") 创建的路由组",
+			method:    http.MethodGet,
+			pattern:   "/v1/unknown",
+			wantTrace: []string{"root", "v1", "v1same"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trace = nil
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.pattern, nil))
+			assert.Equal(t, tc.wantTrace, trace)
+		})
+	}
+
+	// 处理过请求之后再Use的中间件，下一个请求也会生效
+	s.Use(mockMiddleware("late"))
+	trace = nil
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/user", nil))
+	assert.Equal(t, []string{"root", "late", "v1"}, trace)
+	// 没有命中路由的调用链也会重新组装，前面的404已经组装过一次了
+	trace = nil
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1admin", nil))
+	assert.Equal(t, []string{"root", "late"}, trace)
+}
+
+// benchResponseWriter 压测专用的响应对象，避免httptest.ResponseRecorder本身的内存分配干扰压测结果
+type benchResponseWriter struct {
+	header http.Header
+}
+
+func (w *benchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *benchResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *benchResponseWriter) WriteHeader(statusCode int) {}
+
+// BenchmarkServeHTTP 压测一次命中路由的请求
+// 每个请求都重新组装调用链的时候：1133 B/op	21 allocs/op
+// 注册路由的时候就组装好调用链之后：997 B/op	12 allocs/op
+// 通过sync.Pool复用Context之后：485 B/op	9 allocs/op
+func BenchmarkServeHTTP(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mockMiddleware := func(next geek_web.HandleFunc) geek_web.HandleFunc {
+		return func(ctx *geek_web.Context) {
+			next(ctx)
+		}
+	}
+	s := geek_web.NewHTTPServer()
+	s.Use(mockMiddleware)
+	v1 := s.Group("/v1")
+	v1.Use(mockMiddleware, mockMiddleware)
+	v1.GET("/user/:id", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte("hello"))
+	})
+
+	w := &benchResponseWriter{header: http.Header{}}
+	r := httptest.NewRequest(http.MethodGet, "/v1/user/15", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(w, r)
+	}
+}
+
+func TestServerRouteMiddleware(t *testing.T) {
+	var trace []string
+	mockMiddleware := func(name string) geek_web.Middleware {
+		return func(next geek_web.HandleFunc) geek_web.HandleFunc {
+			return func(ctx *geek_web.Context) {
+				trace = append(trace, name)
+				next(ctx)
+			}
+		}
+	}
+	authMiddleware := func(next geek_web.HandleFunc) geek_web.HandleFunc {
+		return func(ctx *geek_web.Context) {
+			trace = append(trace, "auth")
+			if ctx.Request.Header.Get("Authorization") == "" {
+				ctx.SetStatusCode(http.StatusUnauthorized)
+				return
+			}
+			next(ctx)
+		}
+	}
+	mockHandler := func(ctx *geek_web.Context) {
+		trace = append(trace, "handler")
+	}
+
+	s := geek_web.NewHTTPServer()
+	admin := s.Group("/admin")
+	admin.Use(mockMiddleware("admin"))
+	admin.GET("/stats", mockHandler, authMiddleware, mockMiddleware("rate"))
+	admin.GET("/public", mockHandler)
+
+	testCases := []struct {
+		name       string
+		pattern    string
+		auth       string
+		wantStatus int
+		wantTrace  []string
+	}{
+		{
+			name:       "路由中间件在路由组中间件之后执行",
+			pattern:    "/admin/stats",
+			auth:       "token",
+			wantStatus: http.StatusOK,
+			wantTrace:  []string{"admin", "auth", "rate", "handler"},
+		},
+		{
+			name:       "路由中间件拦截请求",
+			pattern:    "/admin/stats",
+			wantStatus: http.StatusUnauthorized,
+			wantTrace:  []string{"admin", "auth"},
+		},
+		{
+			name:       "路由中间件不会影响其他路由",
+			pattern:    "/admin/public",
+			wantStatus: http.StatusOK,
+			wantTrace:  []string{"admin", "handler"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trace = nil
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.pattern, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantStatus, recorder.Code)
+			assert.Equal(t, tc.wantTrace, trace)
+		})
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	var hooks []string
+	s := geek_web.NewHTTPServer(
+		geek_web.ServerWithOnStart(func(ctx context.Context) error {
+			hooks = append(hooks, "start")
+			return nil
+		}),
+		geek_web.ServerWithOnShutdown(func(ctx context.Context) error {
+			hooks = append(hooks, "shutdown")
+			return nil
+		}),
+	)
+	processing := make(chan struct{})
+	s.GET("/slow", func(ctx *geek_web.Context) {
+		close(processing)
+		time.Sleep(time.Millisecond * 200)
+		ctx.String(http.StatusOK, []byte("done"))
+	})
+
+	addr := freeAddr(t)
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.Start(addr)
+	}()
+	// 等待服务启动
+	var resp *http.Response
+	respErr := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 50; i++ {
+			resp, err = http.Get("http://" + addr + "/slow")
+			if err == nil {
+				respErr <- nil
+				return
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		respErr <- err
+	}()
+	<-processing
+	// 请求正在处理的时候退出，需要等待请求处理完
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-respErr)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "done", string(body))
+	assert.NoError(t, <-startErr)
+	assert.Equal(t, []string{"start", "shutdown"}, hooks)
+}
+
+// freeAddr 找一个空闲的端口
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+	return addr
+}
+
+func TestServerStartTLS(t *testing.T) {
+	certFile, keyFile, err := geek_web.WriteSelfSignedCert(t.TempDir())
+	assert.NoError(t, err)
+	certPEM, err := os.ReadFile(certFile)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(certPEM))
+
+	tlsAddr, redirectAddr := freeAddr(t), freeAddr(t)
+	s := geek_web.NewHTTPServer(
+		geek_web.ServerWithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}),
+		geek_web.ServerWithHTTPSRedirect(redirectAddr),
+		geek_web.ServerWithMaxHeaderBytes(1<<10),
+	)
+	s.GET("/user", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte(ctx.Request.Proto))
+	})
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.StartTLS(tlsAddr, certFile, keyFile)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		// 不自动跟随重定向，方便检查重定向的地址
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("https://" + tlsAddr + "/user")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, resp.TLS)
+	assert.NoError(t, resp.Body.Close())
+
+	resp, err = client.Get("http://" + redirectAddr + "/user?id=1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "https://"+tlsAddr+"/user?id=1", resp.Header.Get("Location"))
+	assert.NoError(t, resp.Body.Close())
+
+	// 重定向的服务和HTTPS服务使用同样的限制
+	req, err := http.NewRequest(http.MethodGet, "http://"+redirectAddr+"/user", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Large", strings.Repeat("a", 16<<10))
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	assert.NoError(t, resp.Body.Close())
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-startErr)
+}
+
+// TestServerStartTLSInvalidCert 证书错误的时候，重定向的服务也要关掉，不能一直占着端口
+func TestServerStartTLSInvalidCert(t *testing.T) {
+	dir := t.TempDir()
+	tlsAddr, redirectAddr := freeAddr(t), freeAddr(t)
+	s := geek_web.NewHTTPServer(geek_web.ServerWithHTTPSRedirect(redirectAddr))
+	err := s.StartTLS(tlsAddr, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.Error(t, err)
+
+	// 两个端口都已经释放了
+	for _, addr := range []string{tlsAddr, redirectAddr} {
+		l, err := net.Listen("tcp", addr)
+		assert.NoError(t, err)
+		if err == nil {
+			assert.NoError(t, l.Close())
+		}
+	}
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestServerWithListener(t *testing.T) {
+	// Unix Domain Socket 的路径不能太长，这里不用t.TempDir()
+	dir, err := os.MkdirTemp("", "geek-web")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "web.sock")
+	l, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+
+	s := geek_web.NewHTTPServer(
+		geek_web.ServerWithListener(l),
+		geek_web.ServerWithReadHeaderTimeout(time.Millisecond*100),
+		geek_web.ServerWithMaxHeaderBytes(1<<10),
+	)
+	s.GET("/user", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte("unix"))
+	})
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.Start("")
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://unix/user")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "unix", string(body))
+
+	// 慢连接：迟迟不发送完整的请求头，超时之后连接会被服务端关闭
+	conn, err := net.Dial("unix", sock)
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("GET /user HTTP/1.1\r\nHost: unix\r\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*2)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	// 请求头太大
+	req, err := http.NewRequest(http.MethodGet, "http://unix/user", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Large", strings.Repeat("a", 16<<10))
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	assert.NoError(t, resp.Body.Close())
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-startErr)
+}
+
+// TestServerStartUnix addr 使用 unix: 前缀监听Unix Domain Socket
+func TestServerStartUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "geek-web")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "web.sock")
+	// 上次异常退出留下来的socket文件，启动的时候会被删掉
+	stale, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+	_, err = os.Stat(sock)
+	assert.NoError(t, err)
+
+	s := geek_web.NewHTTPServer()
+	s.GET("/user", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte("unix"))
+	})
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- s.Start("unix:" + sock)
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://unix/user")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, "unix", string(body))
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-startErr)
+
+	// 不是socket的普通文件不能被删掉
+	file := filepath.Join(dir, "web.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("data"), 0o644))
+	assert.Error(t, geek_web.NewHTTPServer().Start("unix:"+file))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+// TestServerContextPool 并发请求下，复用的Context不能把上一个请求的数据串到下一个请求中
+// 配合 go test -race 使用效果更好
+func TestServerContextPool(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := geek_web.NewHTTPServer()
+	s.GET("/user/:id", func(ctx *geek_web.Context) {
+		id, _ := ctx.Param("id")
+		// 上一个请求留下来的数据
+		if _, exists := ctx.Get("id"); exists {
+			ctx.String(http.StatusInternalServerError, []byte("keys leaked"))
+			return
+		}
+		if _, err := ctx.Param("name"); err == nil {
+			ctx.String(http.StatusInternalServerError, []byte("params leaked"))
+			return
+		}
+		query, _ := ctx.Query("q")
+		ctx.Set("id", id)
+		if query != "" {
+			ctx.SetHeader("X-Query", query)
+		}
+		ctx.String(http.StatusOK, []byte(ctx.GetString("id")))
+	})
+	s.GET("/name/:name", func(ctx *geek_web.Context) {
+		ctx.Set("id", "name")
+		ctx.SetStatusCode(http.StatusCreated)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id := strconv.Itoa(i*100 + j)
+				pattern := "/user/" + id
+				if j%2 == 0 {
+					pattern += "?q=" + id
+				}
+				recorder := httptest.NewRecorder()
+				s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, pattern, nil))
+				assert.Equal(t, http.StatusOK, recorder.Code)
+				assert.Equal(t, id, recorder.Body.String())
+				if j%2 == 0 {
+					assert.Equal(t, id, recorder.Header().Get("X-Query"))
+				} else {
+					assert.Equal(t, "", recorder.Header().Get("X-Query"))
+				}
+
+				recorder = httptest.NewRecorder()
+				s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/name/"+id, nil))
+				assert.Equal(t, http.StatusCreated, recorder.Code)
+				assert.Equal(t, "", recorder.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServerHandleFuncE(t *testing.T) {
+	s := geek_web.NewHTTPServer()
+	s.GET("/ok", geek_web.WithError(func(ctx *geek_web.Context) error {
+		ctx.String(http.StatusOK, []byte("ok"))
+		return nil
+	}))
+	s.GET("/http", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return geek_web.NewHTTPError(http.StatusNotFound, "用户<不存在>").Wrap(errors.New("db: no rows"))
+	}))
+	s.GET("/default-message", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return geek_web.NewHTTPError(http.StatusConflict)
+	}))
+	s.GET("/param/:id", geek_web.WithError(func(ctx *geek_web.Context) error {
+		_, err := ctx.ParamInt64("id")
+		return err
+	}))
+	s.GET("/validate", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return ctx.Validate(&struct {
+			Name string `json:"name" validate:"required"`
+		}{})
+	}))
+	s.GET("/internal", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return fmt.Errorf("wrapped: %w", errors.New("secret detail"))
+	}))
+
+	testCases := []struct {
+		name     string
+		url      string
+		accept   string
+		wantCode int
+		wantBody string
+	}{
+		{name: "没有错误", url: "/ok", wantCode: http.StatusOK, wantBody: "ok"},
+		{name: "HTTPError", url: "/http", wantCode: http.StatusNotFound, wantBody: `{"detail":"用户\u003c不存在\u003e","instance":"/http","status":404,"title":"Not Found","type":"about:blank"}`},
+		{name: "默认的错误信息", url: "/default-message", wantCode: http.StatusConflict, wantBody: `{"detail":"Conflict","instance":"/default-message","status":409,"title":"Conflict","type":"about:blank"}`},
+		{
+			name: "ParamError", url: "/param/abc", wantCode: http.StatusBadRequest,
+			wantBody: `{"detail":"Web: param 参数 id 的值 abc 不是合法的整数","instance":"/param/abc","status":400,"title":"Bad Request","type":"about:blank"}`,
+		},
+		{
+			name: "ValidationErrors", url: "/validate", wantCode: http.StatusBadRequest,
+			wantBody: `{"detail":"Web: 参数校验失败 name 是必填字段","errors":[{"field":"name","rule":"required","message":"name 是必填字段"}],` +
+				`"instance":"/validate","status":400,"title":"Bad Request","type":"about:blank"}`,
+		},
+		{name: "其他错误不暴露细节", url: "/internal", wantCode: http.StatusInternalServerError, wantBody: `{"detail":"Internal Server Error","instance":"/internal","status":500,"title":"Internal Server Error","type":"about:blank"}`},
+		{
+			name: "HTML", url: "/http", accept: "text/html,application/xhtml+xml,*/*;q=0.8", wantCode: http.StatusNotFound,
+			wantBody: "<!DOCTYPE html><html><head><title>404</title></head><body><h1>404 用户&lt;不存在&gt;</h1></body></html>",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, tc.wantBody, recorder.Body.String())
+		})
+	}
+}
+
+func TestServerWithErrorHandler(t *testing.T) {
+	var handled error
+	s := geek_web.NewHTTPServer(geek_web.ServerWithErrorHandler(func(ctx *geek_web.Context, err error) {
+		handled = err
+		ctx.String(http.StatusTeapot, []byte(err.Error()))
+	}))
+	s.GET("/error", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return errors.New("boom")
+	}))
+	// HandleFunc 中也可以手动交给错误处理函数
+	s.GET("/manual", func(ctx *geek_web.Context) {
+		ctx.HandleError(errors.New("manual"))
+	})
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/error", nil))
+	assert.Equal(t, http.StatusTeapot, recorder.Code)
+	assert.Equal(t, "boom", recorder.Body.String())
+	assert.EqualError(t, handled, "boom")
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/manual", nil))
+	assert.Equal(t, "manual", recorder.Body.String())
+}
+
+func TestServerInvalidHandler(t *testing.T) {
+	s := geek_web.NewHTTPServer()
+	var nilHandler geek_web.HandleFunc
+	assert.Panics(t, func() { s.GET("/nil", nil) })
+	assert.Panics(t, func() { s.GET("/typed-nil", nilHandler) })
+	assert.Panics(t, func() { s.GET("/error-nil", geek_web.WithError(nil)) })
+}
+
+func TestServerProblem(t *testing.T) {
+	s := geek_web.NewHTTPServer()
+	s.GET("/user", func(ctx *geek_web.Context) {
+		ctx.String(http.StatusOK, []byte("ok"))
+	})
+	s.GET("/panic", func(ctx *geek_web.Context) {
+		panic("boom")
+	})
+	outOfStock := geek_web.NewProblem(http.StatusConflict, "库存不足").With("balance", 30)
+	outOfStock.Type = "https://example.com/probs/out-of-stock"
+	s.POST("/order", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return outOfStock
+	}))
+	// 没有设置状态码的错误当作500
+	s.GET("/no-status", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return &geek_web.HTTPError{Message: "x"}
+	}))
+	s.GET("/no-status-problem", geek_web.WithError(func(ctx *geek_web.Context) error {
+		return &geek_web.Problem{Title: "x"}
+	}))
+	s.GET("/problem", func(ctx *geek_web.Context) {
+		// 扩展字段不能覆盖标准字段
+		ctx.Problem(geek_web.NewProblem(http.StatusForbidden, "没有权限").With("status", 200).With("account", "/account/1"))
+	})
+
+	testCases := []struct {
+		name            string
+		method          string
+		url             string
+		accept          string
+		wantCode        int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name: "404 JSON", method: http.MethodGet, url: "/missing", accept: "application/json",
+			wantCode: http.StatusNotFound, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"detail":"404 NOT FOUND","instance":"/missing","status":404,"title":"Not Found","type":"about:blank"}`,
+		},
+		{
+			name: "404 problem+json", method: http.MethodGet, url: "/missing", accept: "application/problem+json",
+			wantCode: http.StatusNotFound, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"detail":"404 NOT FOUND","instance":"/missing","status":404,"title":"Not Found","type":"about:blank"}`,
+		},
+		{name: "404 没有Accept", method: http.MethodGet, url: "/missing", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{name: "404 */*", method: http.MethodGet, url: "/missing", accept: "*/*", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		// 客户端不能接受JSON的时候都响应纯文本
+		{name: "404 HTML", method: http.MethodGet, url: "/missing", accept: "text/html", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{name: "404 XML", method: http.MethodGet, url: "/missing", accept: "application/xml", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{name: "404 图片", method: http.MethodGet, url: "/missing", accept: "image/png", wantCode: http.StatusNotFound, wantBody: "404 NOT FOUND"},
+		{
+			name: "视图函数返回Problem 图片", method: http.MethodPost, url: "/order", accept: "image/png",
+			wantCode: http.StatusConflict, wantContentType: "text/plain; charset=utf-8", wantBody: "库存不足",
+		},
+		{
+			name: "405 JSON", method: http.MethodPost, url: "/user", accept: "application/json",
+			wantCode: http.StatusMethodNotAllowed, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"detail":"405 METHOD NOT ALLOWED","instance":"/user","status":405,"title":"Method Not Allowed","type":"about:blank"}`,
+		},
+		{
+			name: "500 JSON", method: http.MethodGet, url: "/panic", accept: "application/json",
+			wantCode: http.StatusInternalServerError, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"detail":"Server Internal Error, Please Try Again Later!","instance":"/panic","status":500,` +
+				`"title":"Internal Server Error","type":"about:blank"}`,
+		},
+		{
+			name: "500 纯文本", method: http.MethodGet, url: "/panic",
+			wantCode: http.StatusInternalServerError, wantBody: "Server Internal Error, Please Try Again Later!",
+		},
+		{
+			name: "视图函数返回Problem", method: http.MethodPost, url: "/order",
+			wantCode: http.StatusConflict, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"balance":30,"detail":"库存不足","instance":"/order","status":409,"title":"Conflict","type":"https://example.com/probs/out-of-stock"}`,
+		},
+		{
+			name: "没有状态码 HTML", method: http.MethodGet, url: "/no-status", accept: "text/html",
+			wantCode: http.StatusInternalServerError, wantContentType: "text/html; charset=utf-8",
+			wantBody: "<!DOCTYPE html><html><head><title>500</title></head><body><h1>500 x</h1></body></html>",
+		},
+		{
+			name: "没有状态码 纯文本", method: http.MethodGet, url: "/no-status", accept: "text/plain",
+			wantCode: http.StatusInternalServerError, wantContentType: "text/plain; charset=utf-8", wantBody: "x",
+		},
+		{
+			name: "没有状态码的Problem HTML", method: http.MethodGet, url: "/no-status-problem", accept: "text/html",
+			wantCode: http.StatusInternalServerError, wantContentType: "text/html; charset=utf-8",
+			wantBody: "<!DOCTYPE html><html><head><title>500</title></head><body><h1>500 x</h1></body></html>",
+		},
+		{
+			name: "没有状态码的Problem 纯文本", method: http.MethodGet, url: "/no-status-problem", accept: "text/plain",
+			wantCode: http.StatusInternalServerError, wantContentType: "text/plain; charset=utf-8", wantBody: "x",
+		},
+		{
+			name: "没有状态码的Problem JSON", method: http.MethodGet, url: "/no-status-problem", accept: "application/json",
+			wantCode: http.StatusInternalServerError, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"instance":"/no-status-problem","status":500,"title":"x"}`,
+		},
+		{
+			name: "ctx.Problem", method: http.MethodGet, url: "/problem",
+			wantCode: http.StatusForbidden, wantContentType: geek_web.MIMEProblemJSON,
+			wantBody: `{"account":"/account/1","detail":"没有权限","status":403,"title":"Forbidden","type":"about:blank"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			if tc.wantContentType != "" {
+				assert.Equal(t, tc.wantContentType, recorder.Header().Get("Content-Type"))
+			}
+			assert.Equal(t, tc.wantBody, recorder.Body.String())
+		})
+	}
+	// 全局的Problem不会被修改
+	assert.Equal(t, "", outOfStock.Instance)
+}
+
+func TestServerTyped(t *testing.T) {
+	type createUserReq struct {
+		GroupID int64  `uri:"group_id"`
+		Name    string `json:"name" form:"name" query:"name" validate:"required"`
+		Notify  bool   `query:"notify"`
+	}
+	type user struct {
+		ID      int64  `json:"id"`
+		GroupID int64  `json:"group_id"`
+		Name    string `json:"name"`
+		Notify  bool   `json:"notify"`
+	}
+	type getUserReq struct {
+		ID int64 `uri:"id"`
+	}
+	create := geek_web.Typed(func(ctx *geek_web.Context, req *createUserReq) (user, error) {
+		if req.Name == "admin" {
+			return user{}, geek_web.NewHTTPError(http.StatusConflict, "用户已存在")
+		}
+		ctx.SetStatusCode(http.StatusCreated)
+		return user{ID: 1, GroupID: req.GroupID, Name: req.Name, Notify: req.Notify}, nil
+	})
+	s := geek_web.NewHTTPServer()
+	s.POST("/group/:group_id/user", create)
+	s.GET("/user/:id", geek_web.Typed(func(ctx *geek_web.Context, req getUserReq) (geek_web.H, error) {
+		return geek_web.H{"id": req.ID}, nil
+	}))
+	formats := geek_web.Typed(func(ctx *geek_web.Context, req getUserReq) (geek_web.H, error) {
+		return geek_web.H{"id": req.ID}, nil
+	}, geek_web.MIMEYAML, geek_web.MIMEXML)
+	s.GET("/formats/:id", formats)
+
+	testCases := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		accept      string
+		body        string
+		wantCode    int
+		wantBody    string
+		// 不为空的时候校验响应的Content-Type
+		wantContentType string
+		// 是否做了内容协商
+		wantVary bool
+	}{
+		{
+			name: "JSON请求体", method: http.MethodPost, url: "/group/7/user?notify=true",
+			contentType: "application/json", body: `{"name":"Tom"}`,
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Tom","notify":true}`,
+		},
+		{
+			name: "表单请求体", method: http.MethodPost, url: "/group/7/user",
+			contentType: "application/x-www-form-urlencoded", body: "name=Jerry",
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Jerry","notify":false}`,
+		},
+		{
+			// 和BindForm一样，请求体比查询参数优先
+			name: "表单请求体优先于查询参数", method: http.MethodPost, url: "/group/7/user?name=Query",
+			contentType: "application/x-www-form-urlencoded", body: "name=Jerry",
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Jerry","notify":false}`,
+		},
+		{
+			name: "JSON请求体优先于查询参数", method: http.MethodPost, url: "/group/7/user?name=Query",
+			contentType: "application/json", body: `{"name":"Tom"}`,
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Tom","notify":false}`,
+		},
+		{
+			name: "请求体没有的字段用查询参数", method: http.MethodPost, url: "/group/7/user?name=Query",
+			contentType: "application/json", body: `{}`,
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Query","notify":false}`,
+		},
+		{
+			// 没有声明其他格式的时候只响应JSON，不做内容协商
+			name: "默认只响应JSON", method: http.MethodGet, url: "/user/15", accept: "application/xml",
+			wantCode: http.StatusOK, wantContentType: "application/json", wantBody: `{"id":15}`,
+		},
+		{
+			name: "浏览器的Accept", method: http.MethodGet, url: "/formats/15",
+			accept:   "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			wantCode: http.StatusOK, wantContentType: "application/json", wantBody: `{"id":15}`, wantVary: true,
+		},
+		{
+			name: "声明过的格式YAML", method: http.MethodGet, url: "/formats/15", accept: "application/yaml",
+			wantCode: http.StatusOK, wantContentType: "application/yaml", wantBody: "id: 15\n", wantVary: true,
+		},
+		{
+			// XML不支持map，退回到JSON
+			name: "编码失败退回JSON", method: http.MethodGet, url: "/formats/15", accept: "application/xml",
+			wantCode: http.StatusOK, wantContentType: "application/json", wantBody: `{"id":15}`, wantVary: true,
+		},
+		{
+			name: "通配符", method: http.MethodGet, url: "/formats/15", accept: "*/*",
+			wantCode: http.StatusOK, wantContentType: "application/json", wantBody: `{"id":15}`, wantVary: true,
+		},
+		{
+			name: "都不能接受的时候也响应JSON", method: http.MethodGet, url: "/formats/15", accept: "image/png",
+			wantCode: http.StatusOK, wantContentType: "application/json", wantBody: `{"id":15}`, wantVary: true,
+		},
+		{
+			// 路由参数优先级最高，请求体里面的同名字段不生效
+			name: "路由参数优先", method: http.MethodPost, url: "/group/7/user",
+			contentType: "application/json", body: `{"GroupID":9,"name":"Tom"}`,
+			wantCode: http.StatusCreated, wantBody: `{"id":1,"group_id":7,"name":"Tom","notify":false}`,
+		},
+		{
+			name: "JSON格式错误", method: http.MethodPost, url: "/group/7/user",
+			contentType: "application/json", body: `{"name":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "路由参数类型错误", method: http.MethodPost, url: "/group/abc/user",
+			contentType: "application/json", body: `{"name":"Tom"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "参数校验失败", method: http.MethodPost, url: "/group/7/user",
+			contentType: "application/json", body: `{}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "视图函数返回错误", method: http.MethodPost, url: "/group/7/user",
+			contentType: "application/json", body: `{"name":"admin"}`,
+			wantCode: http.StatusConflict,
+			wantBody: `{"detail":"用户已存在","instance":"/group/7/user","status":409,"title":"Conflict","type":"about:blank"}`,
+		},
+		{
+			name: "没有请求体", method: http.MethodGet, url: "/user/15",
+			wantCode: http.StatusOK, wantBody: `{"id":15}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, recorder.Body.String())
+			}
+			if tc.wantContentType != "" {
+				assert.Equal(t, tc.wantContentType, recorder.Header().Get("Content-Type"))
+			}
+			if tc.wantVary {
+				assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+			} else {
+				assert.Empty(t, recorder.Header().Get("Vary"))
+			}
+		})
+	}
+
+	info, ok := geek_web.TypedInfoOf(create)
+	assert.True(t, ok)
+	assert.Equal(t, reflect.TypeOf(&createUserReq{}), info.Request)
+	assert.Equal(t, reflect.TypeOf(user{}), info.Response)
+	assert.Empty(t, info.Formats)
+	info, ok = geek_web.TypedInfoOf(formats)
+	assert.True(t, ok)
+	assert.Equal(t, []string{geek_web.MIMEYAML, geek_web.MIMEXML}, info.Formats)
+	_, ok = geek_web.TypedInfoOf(func(ctx *geek_web.Context) {
+		t.Fatal("普通的视图函数不能被调用")
+	})
+	assert.False(t, ok)
+	assert.Panics(t, func() {
+		geek_web.Typed(func(ctx *geek_web.Context, req string) (string, error) {
+			return req, nil
+		})
+	})
+}
+
+func TestServerOpenAPI(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type user struct {
+		ID       int64     `json:"id"`
+		Name     string    `json:"name"`
+		Birthday time.Time `json:"birthday"`
+		Address  *address  `json:"address,omitempty"`
+		Friends  []*user   `json:"friends,omitempty"`
+		password string
+	}
+	type createUserReq struct {
+		GroupID int64             `uri:"group_id"`
+		Notify  bool              `query:"notify"`
+		Token   string            `header:"X-Token" validate:"required"`
+		Name    string            `json:"name" form:"name" validate:"required,min=2,max=20"`
+		Role    string            `json:"role" validate:"oneof=admin member"`
+		Labels  map[string]string `json:"labels" validate:"max=3"`
+		Ignored string            `json:"-"`
+	}
+	type listUserReq struct {
+		Page int `query:"page" validate:"min=1"`
+		Size int
+	}
+	s := geek_web.NewHTTPServer()
+	s.POST("/group/:group_id/user", geek_web.Typed(func(ctx *geek_web.Context, req createUserReq) (*user, error) {
+		return &user{}, nil
+	}, geek_web.MIMEYAML)).Summary("创建用户").Tags("user")
+	s.GET("/user", func(ctx *geek_web.Context) {}).Request(listUserReq{}).Response([]user{}).Deprecated()
+	s.GET("/order/:id(^[0-9]+$)", func(ctx *geek_web.Context) {})
+	s.GET("/assets/*filepath", func(ctx *geek_web.Context) {})
+	s.GET("/files/<[a-z]+\\.pdf>", func(ctx *geek_web.Context) {})
+	s.Any("/ping", func(ctx *geek_web.Context) {}).Summary("ping")
+	info := geek_web.OpenAPIInfo{Title: "用户服务", Version: "1.0.0"}
+	s.GET("/openapi.json", s.OpenAPIHandler(info)).Hidden()
+	s.GET("/docs", geek_web.SwaggerUIHandler(info.Title, "/openapi.json")).Hidden()
+
+	doc := s.OpenAPI(info)
+	assert.Equal(t, geek_web.OpenAPIVersion, doc.OpenAPI)
+	assert.Equal(t, info, doc.Info)
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// 隐藏的路由不会出现在文档中
+	assert.Equal(t, []string{"/assets/{filepath}", "/files/{param1}", "/group/{group_id}/user", "/order/{id}", "/ping", "/user"}, paths)
+	// CONNECT 没办法在OpenAPI中表示
+	assert.Len(t, doc.Paths["/ping"], 8)
+	assert.Equal(t, "ping", doc.Paths["/ping"]["trace"].Summary)
+
+	// 通配符参数可以包含 /，需要在参数上说明
+	assets := doc.Paths["/assets/{filepath}"]["get"].Parameters
+	assert.Len(t, assets, 1)
+	assert.Equal(t, "filepath", assets[0].Name)
+	assert.Contains(t, assets[0].Description, "可以包含 /")
+
+	create := doc.Paths["/group/{group_id}/user"]["post"]
+	assert.Equal(t, "创建用户", create.Summary)
+	assert.Equal(t, []string{"user"}, create.Tags)
+	assert.Equal(t, []*geek_web.OpenAPIParameter{
+		{Name: "group_id", In: "path", Required: true, Schema: &geek_web.OpenAPISchema{Type: "integer", Format: "int64"}},
+		{Name: "notify", In: "query", Schema: &geek_web.OpenAPISchema{Type: "boolean"}},
+		{Name: "X-Token", In: "header", Required: true, Schema: &geek_web.OpenAPISchema{Type: "string"}},
+	}, create.Parameters)
+	minLength, maxLength, maxLabels := 2, 20, 3
+	body := create.RequestBody.Content[geek_web.MIMEJSON].Schema
+	assert.Equal(t, &geek_web.OpenAPISchema{
+		Type: "object",
+		Properties: map[string]*geek_web.OpenAPISchema{
+			"name": {Type: "string", MinLength: &minLength, MaxLength: &maxLength},
+			"role": {Type: "string", Enum: []any{"admin", "member"}},
+			"labels": {
+				Type: "object", AdditionalProperties: &geek_web.OpenAPISchema{Type: "string"}, MaxProperties: &maxLabels,
+			},
+		},
+		Required: []string{"name"},
+	}, body)
+	assert.Contains(t, create.RequestBody.Content, "application/x-www-form-urlencoded")
+	assert.Equal(t, "#/components/schemas/user", create.Responses["200"].Content[geek_web.MIMEJSON].Schema.Ref)
+	// Typed 声明过的其他响应格式
+	assert.Equal(t, "#/components/schemas/user", create.Responses["200"].Content[geek_web.MIMEYAML].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/Problem", create.Responses["default"].Content[geek_web.MIMEProblemJSON].Schema.Ref)
+
+	list := doc.Paths["/user"]["get"]
+	assert.True(t, list.Deprecated)
+	page := float64(1)
+	assert.Equal(t, []*geek_web.OpenAPIParameter{
+		{Name: "page", In: "query", Schema: &geek_web.OpenAPISchema{Type: "integer", Format: "int64", Minimum: &page}},
+		{Name: "Size", In: "query", Schema: &geek_web.OpenAPISchema{Type: "integer", Format: "int64"}},
+	}, list.Parameters)
+	assert.Nil(t, list.RequestBody)
+	assert.Equal(t, &geek_web.OpenAPISchema{Type: "array", Items: &geek_web.OpenAPISchema{Ref: "#/components/schemas/user"}},
+		list.Responses["200"].Content[geek_web.MIMEJSON].Schema)
+
+	// 结构体引用自己的时候不会无限递归
+	assert.Equal(t, &geek_web.OpenAPISchema{
+		Type: "object",
+		Properties: map[string]*geek_web.OpenAPISchema{
+			"id":       {Type: "integer", Format: "int64"},
+			"name":     {Type: "string"},
+			"birthday": {Type: "string", Format: "date-time"},
+			"address":  {Ref: "#/components/schemas/address"},
+			"friends":  {Type: "array", Items: &geek_web.OpenAPISchema{Ref: "#/components/schemas/user"}},
+		},
+	}, doc.Components.Schemas["user"])
+
+	order := doc.Paths["/order/{id}"]["get"]
+	assert.Equal(t, &geek_web.OpenAPIParameter{Name: "id", In: "path", Required: true,
+		Schema: &geek_web.OpenAPISchema{Type: "string", Pattern: "^(?:^[0-9]+$)$"}}, order.Parameters[0])
+	// <expr> 写法没有 ^$，文档里面的pattern同样是整段匹配
+	files := doc.Paths["/files/{param1}"]["get"]
+	assert.Equal(t, "^(?:[a-z]+\\.pdf)$", files.Parameters[0].Schema.Pattern)
+	assert.Equal(t, map[string]*geek_web.OpenAPIResponse{"200": {Description: "OK"}}, order.Responses)
+
+	// 接口文档的视图函数
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, geek_web.MIMEJSON, recorder.Header().Get("Content-Type"))
+	var res map[string]any
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Equal(t, "3.1.0", res["openapi"])
+
+	req = httptest.NewRequest(http.MethodGet, "/openapi.json?format=yaml", nil)
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	assert.Equal(t, geek_web.MIMEYAML, recorder.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(recorder.Body.String(), "openapi: 3.1.0\n"))
+	assert.Contains(t, recorder.Body.String(), "$ref: '#/components/schemas/user'")
+
+	req = httptest.NewRequest(http.MethodGet, "/docs", nil)
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "<title>用户服务</title>")
+	assert.Contains(t, recorder.Body.String(), `url: "/openapi.json"`)
+	assert.Contains(t, recorder.Body.String(), `href="https://unpkg.com/swagger-ui-dist@`+geek_web.SwaggerUIVersion+`/swagger-ui.css" crossorigin>`)
+	assert.NotContains(t, recorder.Body.String(), "integrity")
+
+	// 静态资源放在自己的服务器上，并且校验SRI哈希
+	s.GET("/docs/local", geek_web.SwaggerUIHandler(info.Title, "/openapi.json",
+		geek_web.SwaggerUIWithAssets("/swagger-ui/"),
+		geek_web.SwaggerUIWithIntegrity("sha384-css", "sha384-js"),
+	)).Hidden()
+	req = httptest.NewRequest(http.MethodGet, "/docs/local", nil)
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, req)
+	assert.Contains(t, recorder.Body.String(), `href="/swagger-ui/swagger-ui.css" integrity="sha384-css" crossorigin>`)
+	assert.Contains(t, recorder.Body.String(), `src="/swagger-ui/swagger-ui-bundle.js" integrity="sha384-js" crossorigin>`)
+	assert.NotContains(t, recorder.Body.String(), "unpkg.com")
 }
@@ -0,0 +1,189 @@
+package geek_web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-Sent Events
+
+/*
+SSE 是服务端单向推送数据给浏览器的一种方式，本质上就是一个一直不结束的流式响应
+和WebSocket比起来，SSE就是普通的HTTP请求，不需要升级协议，浏览器断开之后还会自动重连
+
+响应的格式很简单，每个事件之间用一个空行隔开
+	id: 1
+	event: message
+	retry: 3000
+	data: {"count":1}
+
+	: ping
+
+以 : 开头的是注释，浏览器会直接忽略，我们用它来做心跳，防止中间的代理因为长时间没有数据把连接断开
+浏览器重连的时候会带上 Last-Event-ID 请求头，服务端可以从这个ID之后继续推送
+
+s.GET("/events", func(ctx *Context) {
+	events := make(chan SSEvent)
+	go produce(ctx.LastEventID(), events)
+	ctx.SSEStream(events, 15*time.Second)
+})
+*/
+
+// SSEvent 一个SSE事件
+type SSEvent struct {
+	// ID 事件ID，浏览器重连的时候会通过Last-Event-ID带回来
+	ID string
+	// Event 事件名，为空的时候浏览器当作message事件
+	Event string
+	// Data 事件数据，string和[]byte原样发送，其他类型序列化成JSON
+	Data any
+	// Retry 告诉浏览器断开之后隔多久重连，0表示不设置
+	Retry time.Duration
+}
+
+// WriteTo 按照SSE的格式写入事件
+func (e SSEvent) WriteTo(w io.Writer) (int64, error) {
+	data, err := e.encode()
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(w, data)
+	return int64(n), err
+}
+
+// encode 按照SSE的格式编码事件，事件数据序列化失败的时候返回错误
+func (e SSEvent) encode() (string, error) {
+	var sb strings.Builder
+	if e.ID != "" {
+		sb.WriteString("id: " + sseEscape(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		sb.WriteString("event: " + sseEscape(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		sb.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	data, err := sseData(e.Data)
+	if err != nil {
+		return "", err
+	}
+	// 多行数据需要拆成多个data，浏览器会用换行符拼接起来
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String(), nil
+}
+
+// sseNewlines SSE中 \r\n、\r、\n 都是换行符，统一换成 \n 之后再拆成多个data
+// 不然单独的 \r 会把一个事件拆开，甚至伪造出其他的字段
+var sseNewlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// sseData 把事件数据转换成字符串
+func sseData(data any) (string, error) {
+	switch val := data.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return sseNewlines.Replace(val), nil
+	case []byte:
+		return sseNewlines.Replace(string(val)), nil
+	default:
+		bytes, err := json.Marshal(val)
+		if err != nil {
+			return "", fmt.Errorf("Web: SSE事件数据序列化失败 %w", err)
+		}
+		return string(bytes), nil
+	}
+}
+
+// sseEscape id 和 event 里面不能出现换行，不然会被当成下一个字段
+func sseEscape(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// LastEventID 浏览器重连的时候带过来的最后一个事件ID
+// 有些EventSource的polyfill没办法设置请求头，会放在查询参数lastEventId中
+func (c *Context) LastEventID() string {
+	if id := c.Request.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.Request.URL.Query().Get("lastEventId")
+}
+
+// SSEvent 发送一个SSE事件，并且立即刷新到客户端
+// 第一次调用的时候会写入SSE需要的响应头
+// 事件数据序列化失败的时候什么都不会写，直接返回错误
+func (c *Context) SSEvent(name string, data any) error {
+	payload, err := SSEvent{Event: name, Data: data}.encode()
+	if err != nil {
+		return err
+	}
+	return c.writeSSE(payload)
+}
+
+// SSEStream 持续地把events中的事件发送给客户端，直到events被关闭或者客户端断开连接
+// heartbeat 心跳间隔，小于等于0表示不发送心跳
+// 返回值表示是不是客户端先断开了连接
+// 事件数据序列化失败是代码的问题，不是客户端断开了，这种事件会打印日志之后跳过
+func (c *Context) SSEStream(events <-chan SSEvent, heartbeat time.Duration) bool {
+	c.sseHeader()
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	done := c.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return true
+		case <-tick:
+			if _, err := io.WriteString(c.Response, ": ping\n\n"); err != nil {
+				return true
+			}
+			c.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			payload, err := event.encode()
+			if err != nil {
+				log.Printf("SSE EVENT ERROR %4s - %s %v", c.Method, c.Pattern, err)
+				continue
+			}
+			if err = c.writeSSE(payload); err != nil {
+				return true
+			}
+		}
+	}
+}
+
+// writeSSE 写入一个编码好的事件并且立即刷新，返回的错误只会是写入失败
+func (c *Context) writeSSE(payload string) error {
+	c.sseHeader()
+	if _, err := io.WriteString(c.Response, payload); err != nil {
+		return err
+	}
+	c.Flush()
+	return nil
+}
+
+// sseHeader 写入SSE需要的响应头，已经写过响应头的话什么都不做
+func (c *Context) sseHeader() {
+	if c.committed {
+		return
+	}
+	c.SetHeader("Content-Type", "text/event-stream")
+	c.SetHeader("Cache-Control", "no-cache")
+	// 告诉Nginx不要缓冲响应，不然事件会被攒起来一起发送
+	c.SetHeader("X-Accel-Buffering", "no")
+	c.writeHeader()
+	c.Flush()
+}
@@ -0,0 +1,59 @@
+package geek_web
+
+import (
+	"io"
+	"net/http"
+)
+
+// 流式响应
+
+/*
+刷新数据的中间件是在视图函数返回之后才统一写响应的，这对于绝大部分的接口都没有问题
+但是对于下面这些场景就不行了
+	1. 数据是一点一点产生的，需要产生一点就发送一点，例如日志输出、大模型的逐字输出
+	2. 长轮询，请求需要一直挂着，中间不停地发送数据
+
+所以这里提供了流式响应：先把响应头和状态码写出去，后面每次写完数据都立即刷新到客户端
+一旦进入了流式响应，刷新数据的中间件就会跳过，ctx.data 里面的数据也不会再写出去
+
+s.GET("/logs", func(ctx *Context) {
+	ctx.SetHeader("Content-Type", "text/plain")
+	ctx.Stream(func(w io.Writer) bool {
+		line, ok := <-logs
+		if !ok {
+			return false
+		}
+		_, _ = w.Write(line)
+		return true
+	})
+})
+*/
+
+// Stream 流式响应，会一直调用step直到step返回false或者客户端断开连接
+// 每次调用step之后都会立即刷新数据到客户端
+// 返回值表示是不是客户端先断开了连接
+func (c *Context) Stream(step func(w io.Writer) bool) bool {
+	c.writeHeader()
+	done := c.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return true
+		default:
+			keepOpen := step(c.Response)
+			c.Flush()
+			if !keepOpen {
+				return false
+			}
+		}
+	}
+}
+
+// Flush 把已经写到Response中的数据立即发送给客户端
+// 还没有写响应头的话会先写响应头，也就是说调用Flush之后就进入了流式响应
+func (c *Context) Flush() {
+	c.writeHeader()
+	if flusher, ok := c.Response.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,83 @@
+package geek_web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 自签名证书
+// 本地开发和测试的时候，不可能每次都去申请一个真正的证书，所以这里提供一个生成自签名证书的方法
+// 注意：自签名证书浏览器是不信任的，千万不要用在生产环境
+
+// GenerateSelfSignedCert 生成自签名证书，返回PEM格式的证书和私钥
+// hosts 证书绑定的域名或者IP，不传的话默认是localhost和127.0.0.1
+func GenerateSelfSignedCert(hosts ...string) ([]byte, []byte, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"geek-web self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	// 区分一下是IP还是域名
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// WriteSelfSignedCert 生成自签名证书并写入到dir目录下，返回证书和私钥的文件路径
+// 返回的文件路径可以直接交给StartTLS使用
+func WriteSelfSignedCert(dir string, hosts ...string) (string, string, error) {
+	certPEM, keyPEM, err := GenerateSelfSignedCert(hosts...)
+	if err != nil {
+		return "", "", err
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return "", "", err
+	}
+	// 私钥只能自己读写
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
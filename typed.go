@@ -0,0 +1,176 @@
+package geek_web
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// 泛型视图函数
+
+/*
+写JSON接口的时候，每个视图函数都是一样的套路
+	1. 定义一个请求结构体，调用Bind解析参数，解析失败响应400
+	2. 调用Validate校验参数，校验失败响应400
+	3. 处理业务逻辑
+	4. 调用JSON把结果响应回去，出错的时候再响应一个错误
+
+前面四步里面，只有第3步是每个接口不一样的，go.mod 已经要求 Go 1.18，那就可以用泛型把其他几步都收起来
+
+	type CreateUserReq struct {
+		GroupID int64  `uri:"group_id"`
+		Name    string `json:"name" validate:"required"`
+	}
+
+	s.POST("/group/:group_id/user", Typed(func(ctx *Context, req CreateUserReq) (*User, error) {
+		user, err := createUser(req.GroupID, req.Name)
+		if err != nil {
+			return nil, err // 交给错误处理函数
+		}
+		ctx.SetStatusCode(http.StatusCreated) // 不设置状态码的时候是200
+		return user, nil
+	}))
+
+Typed 的执行流程
+	1. 解析查询参数【query标签】
+	2. 有请求体的时候，根据Content-Type调用Bind解析请求体
+	3. 解析路由参数【uri标签】
+	后面解析的会覆盖前面的，所以路由参数的优先级最高，请求体比查询参数优先，和BindForm是一样的
+	4. 调用Validate校验参数，ValidationErrors 交给错误处理函数，响应400
+	5. 调用fn，返回的error交给错误处理函数，否则把Resp序列化成JSON响应回去
+
+默认只响应JSON，浏览器的Accept里面虽然有application/xml，但是响应的结构体一般只写了json标签
+需要其他格式的接口可以在Typed的时候明确声明，这个时候才会根据请求头Accept做内容协商
+	s.GET("/user/:id", Typed(getUser, MIMEXML, MIMEYAML))
+	1. JSON永远是第一个选项，没有Accept、只有通配符或者都不能接受的时候响应JSON
+	2. XML、YAML不认识json标签，字段名按照各自的标签【xml、yaml】生成
+	3. 数据没办法编码成协商出来的格式的时候【例如XML不支持map】，退回到JSON
+
+另外，请求和响应的类型只有在泛型函数里面才知道，Typed 返回的是一个普通的HandleFunc，类型信息就丢了
+所以提供了 TypedInfoOf，让生成接口文档【OpenAPI】之类的功能能够拿到请求和响应的类型
+*/
+
+// TypedInfo 泛型视图函数的请求和响应类型
+type TypedInfo struct {
+	Request  reflect.Type
+	Response reflect.Type
+	// Formats 除了JSON之外还支持的响应格式【MIME类型】
+	Formats []string
+}
+
+// typedCode 所有Typed返回的闭包的代码地址
+// 泛型函数会按照类型的形状生成代码，所以这里的数量是有限的
+// 用来判断一个HandleFunc是不是Typed返回的，不是的话不能拿一个空的Context去调用它
+var typedCode sync.Map
+
+// Typed 把 func(ctx *Context, req Req) (Resp, error) 转换成HandleFunc
+// Req 必须是结构体或者结构体指针，解析参数的规则和Bind一样
+// formats 除了JSON之外还支持的响应格式，例如 MIMEXML，需要通过ServerWithRenderer注册过对应的Renderer
+func Typed[Req any, Resp any](fn func(ctx *Context, req Req) (Resp, error), formats ...string) HandleFunc {
+	if fn == nil {
+		panic("Web: 视图函数不能为nil")
+	}
+	reqType := reflect.TypeOf((*Req)(nil)).Elem()
+	if indirectType(reqType).Kind() != reflect.Struct {
+		panic("Web: Typed 的请求类型必须是结构体或者结构体指针，现在是 " + reqType.String())
+	}
+	info := TypedInfo{
+		Request:  reqType,
+		Response: reflect.TypeOf((*Resp)(nil)).Elem(),
+		Formats:  formats,
+	}
+	h := func(ctx *Context) {
+		if ctx.describe != nil {
+			*ctx.describe = info
+			return
+		}
+		var req Req
+		// Req 是指针的时候需要先创建一个结构体
+		obj := any(&req)
+		if reqType.Kind() == reflect.Pointer {
+			val := reflect.New(reqType.Elem())
+			reflect.ValueOf(&req).Elem().Set(val)
+			obj = val.Interface()
+		}
+		if err := ctx.bindTyped(obj); err != nil {
+			ctx.HandleError(err)
+			return
+		}
+		if err := ctx.Validate(obj); err != nil {
+			ctx.HandleError(err)
+			return
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			ctx.HandleError(err)
+			return
+		}
+		// 视图函数里面已经用流式响应把数据写出去了
+		if ctx.committed {
+			return
+		}
+		ctx.renderTyped(ctx.status, resp, formats)
+	}
+	typedCode.Store(reflect.ValueOf(h).Pointer(), struct{}{})
+	return h
+}
+
+// TypedInfoOf 获取Typed返回的视图函数的请求和响应类型，不是Typed返回的视图函数返回false
+func TypedInfoOf(h HandleFunc) (TypedInfo, bool) {
+	if h == nil {
+		return TypedInfo{}, false
+	}
+	if _, ok := typedCode.Load(reflect.ValueOf(h).Pointer()); !ok {
+		return TypedInfo{}, false
+	}
+	var info TypedInfo
+	h(&Context{describe: &info})
+	return info, true
+}
+
+// bindTyped 按照查询参数、请求体、路由参数的顺序解析参数
+// 解析失败统一响应400，请求体太大的时候响应413
+func (c *Context) bindTyped(obj any) error {
+	if err := c.BindQuery(obj); err != nil {
+		return NewHTTPError(http.StatusBadRequest, err.Error()).Wrap(err)
+	}
+	if c.hasBody() {
+		if err := c.Bind(obj); err != nil {
+			if c.bodyTooLarge {
+				return NewHTTPError(http.StatusRequestEntityTooLarge).Wrap(err)
+			}
+			return NewHTTPError(http.StatusBadRequest, err.Error()).Wrap(err)
+		}
+	}
+	if err := c.BindURI(obj); err != nil {
+		return NewHTTPError(http.StatusBadRequest, err.Error()).Wrap(err)
+	}
+	return nil
+}
+
+// hasBody 请求有没有请求体，没有Content-Type的请求体也当作没有
+func (c *Context) hasBody() bool {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody || c.Request.ContentLength == 0 {
+		return false
+	}
+	return c.Request.Header.Get("Content-Type") != ""
+}
+
+// renderTyped 渲染Typed的响应，默认响应JSON，只有在formats中声明过的格式才会参与内容协商
+func (c *Context) renderTyped(code int, data any, formats []string) {
+	if len(formats) > 0 {
+		c.AddHeader("Vary", "Accept")
+		// JSON放在第一个，没有Accept或者 */* 的时候协商出来的就是JSON
+		format := c.NegotiateFormat(append([]string{MIMEJSON}, formats...)...)
+		if r, ok := c.renderer(format); ok && format != MIMEJSON {
+			if bs, err := r.Render(c, data); err == nil {
+				c.SetStatusCode(code)
+				c.SetHeader("Content-Type", negotiatedContentType(format, r.ContentType()))
+				c.SetData(bs)
+				return
+			}
+			// 数据没办法编码成这种格式，退回到JSON，而不是响应500
+		}
+	}
+	c.JSON(code, data)
+}
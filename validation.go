@@ -0,0 +1,326 @@
+package geek_web
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// 参数校验
+
+/*
+参数绑定解决了数据从哪里来的问题，但是数据对不对还需要校验
+同样的，我们也是通过结构体的标签来声明校验规则
+
+type UserReq struct {
+	Name  string `json:"name" validate:"required,min=1,max=64"`
+	Email string `json:"email" validate:"omitempty,email"`
+	Role  string `json:"role" validate:"oneof=admin user"`
+}
+
+支持的规则
+	1. required  必填，零值、空字符串、空切片都算没有填
+	2. omitempty 没有填的时候跳过后面全部的规则
+	3. min=n	 数字表示最小值，字符串表示最少多少个字符，切片和map表示最少多少个元素
+	4. max=n	 和min相反
+	5. len=n	 字符串、切片、map的长度必须是n
+	6. email	 邮箱格式
+	7. oneof=a b 只能是其中的一个，多个值之间用空格隔开
+
+和模板引擎一样，框架提供接口 + 一个默认的实现，想换成其他校验库的用户实现Validator接口即可
+*/
+
+// Validator 校验器
+type Validator interface {
+	// Validate 校验结构体，校验不通过的时候返回ValidationErrors
+	Validate(obj any) error
+}
+
+// FieldError 单个字段的校验错误
+type FieldError struct {
+	// Field 字段名，有json标签的使用json标签中的名字，嵌套的结构体使用 . 连接，例如 address.city
+	Field string `json:"field"`
+	// Rule 没有通过的规则，例如 min
+	Rule string `json:"rule"`
+	// Param 规则的参数，例如 min=1 中的 1
+	Param string `json:"param,omitempty"`
+	// Message 给人看的错误信息
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// ValidationErrors 全部字段的校验错误
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		messages = append(messages, fieldErr.Message)
+	}
+	return "Web: 参数校验失败 " + strings.Join(messages, "; ")
+}
+
+// ShouldBindAndValidate 参数绑定之后再做参数校验
+// 绑定失败返回绑定的错误，校验失败返回ValidationErrors
+func (c *Context) ShouldBindAndValidate(obj any) error {
+	if err := c.Bind(obj); err != nil {
+		return err
+	}
+	return c.Validate(obj)
+}
+
+// Validate 使用HTTPServer上配置的校验器校验结构体
+func (c *Context) Validate(obj any) error {
+	validator := c.validator
+	if validator == nil {
+		validator = defaultValidator
+	}
+	return validator.Validate(obj)
+}
+
+// defaultValidator 默认的校验器
+var defaultValidator = NewTagValidator()
+
+// TagValidator 基于validate标签的校验器
+type TagValidator struct {
+	// cache 缓存每个结构体解析好的校验规则，避免每次都解析标签
+	cache sync.Map
+}
+
+// NewTagValidator 创建一个基于validate标签的校验器
+func NewTagValidator() *TagValidator {
+	return &TagValidator{}
+}
+
+// fieldRules 一个字段上的全部校验规则
+type fieldRules struct {
+	index int    // 字段的下标
+	name  string // 字段名
+	rules []rule // 校验规则
+}
+
+// rule 单个校验规则
+type rule struct {
+	name  string
+	param string
+}
+
+var emailRegexp = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
+
+// Validate 校验结构体
+func (v *TagValidator) Validate(obj any) error {
+	val := reflect.ValueOf(obj)
+	for val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+	errs := make(ValidationErrors, 0)
+	if err := v.validateStruct(val, "", &errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (v *TagValidator) validateStruct(val reflect.Value, namespace string, errs *ValidationErrors) error {
+	fields, err := v.parse(val.Type())
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		fieldVal := val.Field(field.index)
+		name := field.name
+		if namespace != "" {
+			name = namespace + "." + name
+		}
+		if fieldErr, ok := checkField(fieldVal, name, field.rules); !ok {
+			*errs = append(*errs, fieldErr)
+			continue
+		}
+		// 嵌套的结构体继续校验
+		for fieldVal.Kind() == reflect.Pointer && !fieldVal.IsNil() {
+			fieldVal = fieldVal.Elem()
+		}
+		if fieldVal.Kind() == reflect.Struct && fieldVal.Type() != timeType {
+			if err = v.validateStruct(fieldVal, name, errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parse 解析结构体上的校验规则
+func (v *TagValidator) parse(typ reflect.Type) ([]fieldRules, error) {
+	if fields, ok := v.cache.Load(typ); ok {
+		return fields.([]fieldRules), nil
+	}
+	fields := make([]fieldRules, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ","); jsonName != "" && jsonName != "-" {
+			name = jsonName
+		}
+		rules := make([]rule, 0)
+		if tag := field.Tag.Get("validate"); tag != "" && tag != "-" {
+			for _, item := range strings.Split(tag, ",") {
+				ruleName, param, _ := strings.Cut(strings.TrimSpace(item), "=")
+				if err := checkRule(ruleName, param); err != nil {
+					return nil, fmt.Errorf("Web: 字段 %s.%s 的校验规则错误 %w", typ.Name(), field.Name, err)
+				}
+				rules = append(rules, rule{name: ruleName, param: param})
+			}
+		}
+		// 没有规则的结构体字段也需要保存下来，因为结构体里面的字段可能有规则
+		if len(rules) == 0 && indirectType(field.Type).Kind() != reflect.Struct {
+			continue
+		}
+		fields = append(fields, fieldRules{index: i, name: name, rules: rules})
+	}
+	v.cache.Store(typ, fields)
+	return fields, nil
+}
+
+// checkRule 检查规则是否合法，在解析的时候就把错误暴露出来
+func checkRule(name string, param string) error {
+	switch name {
+	case "required", "omitempty", "email":
+		return nil
+	case "min", "max", "len":
+		if _, err := strconv.ParseFloat(param, 64); err != nil {
+			return fmt.Errorf("%s 的参数必须是数字", name)
+		}
+		return nil
+	case "oneof":
+		if strings.TrimSpace(param) == "" {
+			return fmt.Errorf("oneof 的参数不能为空")
+		}
+		return nil
+	default:
+		return fmt.Errorf("未知的校验规则 %s", name)
+	}
+}
+
+// checkField 校验单个字段，第二个返回值表示是否校验通过
+func checkField(val reflect.Value, name string, rules []rule) (FieldError, bool) {
+	empty := isEmpty(val)
+	for _, r := range rules {
+		if r.name == "omitempty" {
+			if empty {
+				return FieldError{}, true
+			}
+			continue
+		}
+		if r.name == "required" {
+			if empty {
+				return FieldError{Field: name, Rule: r.name, Message: fmt.Sprintf("%s 是必填字段", name)}, false
+			}
+			continue
+		}
+		// 指针没有值的时候，后面的规则都没办法校验
+		target := val
+		for target.Kind() == reflect.Pointer {
+			if target.IsNil() {
+				return FieldError{}, true
+			}
+			target = target.Elem()
+		}
+		if message, ok := checkRuleValue(target, name, r); !ok {
+			return FieldError{Field: name, Rule: r.name, Param: r.param, Message: message}, false
+		}
+	}
+	return FieldError{}, true
+}
+
+// checkRuleValue 校验具体的规则
+func checkRuleValue(val reflect.Value, name string, r rule) (string, bool) {
+	switch r.name {
+	case "email":
+		if val.Kind() != reflect.String || !emailRegexp.MatchString(val.String()) {
+			return fmt.Sprintf("%s 不是合法的邮箱", name), false
+		}
+	case "oneof":
+		value := fmt.Sprint(val.Interface())
+		for _, option := range strings.Fields(r.param) {
+			if option == value {
+				return "", true
+			}
+		}
+		return fmt.Sprintf("%s 只能是 [%s] 中的一个", name, r.param), false
+	case "min", "max", "len":
+		limit, _ := strconv.ParseFloat(r.param, 64)
+		size, isLength := measure(val)
+		switch {
+		case r.name == "min" && size < limit:
+			if isLength {
+				return fmt.Sprintf("%s 长度不能小于 %s", name, r.param), false
+			}
+			return fmt.Sprintf("%s 不能小于 %s", name, r.param), false
+		case r.name == "max" && size > limit:
+			if isLength {
+				return fmt.Sprintf("%s 长度不能大于 %s", name, r.param), false
+			}
+			return fmt.Sprintf("%s 不能大于 %s", name, r.param), false
+		case r.name == "len" && size != limit:
+			return fmt.Sprintf("%s 长度必须是 %s", name, r.param), false
+		}
+	}
+	return "", true
+}
+
+// measure 获取用来比较大小的数值
+// 第二个返回值表示比较的是不是长度
+func measure(val reflect.Value) (float64, bool) {
+	switch val.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(val.String())), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(val.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), false
+	default:
+		return 0, false
+	}
+}
+
+// isEmpty 判断字段有没有填
+func isEmpty(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return val.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return val.IsNil()
+	default:
+		return val.IsZero()
+	}
+}
+
+// indirectType 获取指针指向的类型
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ
+}
@@ -0,0 +1,42 @@
+package geek_web
+
+import (
+	"github.com/borntodie-new/geek-web/websocket"
+)
+
+// WebSocket
+
+/*
+WebSocket 的握手是一个普通的GET请求，握手成功之后需要接管【Hijack】底层的TCP连接
+接管之后Response就不能再使用了，所以升级之后刷新数据的中间件必须跳过
+具体的协议实现在websocket子包中，子包不依赖框架，这里只是把Context接上去
+
+s.GET("/ws", func(ctx *Context) {
+	conn, err := ctx.Upgrade(nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMessage(mt, msg)
+	}
+})
+*/
+
+// defaultUpgrader 默认的Upgrader，只允许同源的请求，一个消息最多websocket.DefaultReadLimit个字节
+var defaultUpgrader = &websocket.Upgrader{}
+
+// Upgrade 把当前请求升级成WebSocket连接，upgrader为nil的时候使用默认配置
+// 通过SetHeader设置的响应头会跟着握手响应一起发送
+// 无论升级成功还是失败，响应都已经写出去了，后面再设置状态码和响应数据都是无效的
+func (c *Context) Upgrade(upgrader *websocket.Upgrader) (*websocket.Conn, error) {
+	if upgrader == nil {
+		upgrader = defaultUpgrader
+	}
+	c.committed = true
+	return upgrader.Upgrade(c.Response, c.Request, c.header)
+}
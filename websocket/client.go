@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 客户端主要是给测试用的，也可以用来在服务之间建立WebSocket连接
+
+// ErrBadHandshake 服务端的握手响应不合法
+var ErrBadHandshake = errors.New("websocket: 握手失败")
+
+// Dialer 建立WebSocket连接
+type Dialer struct {
+	// HandshakeTimeout 建立连接和握手的超时时间，0表示不限制
+	HandshakeTimeout time.Duration
+	// Subprotocols 请求的子协议
+	Subprotocols []string
+	// EnableCompression 是否请求使用permessage-deflate压缩
+	EnableCompression bool
+	// TLSClientConfig wss 使用的TLS配置
+	TLSClientConfig *tls.Config
+}
+
+// DefaultDialer 默认的Dialer
+var DefaultDialer = &Dialer{HandshakeTimeout: 45 * time.Second}
+
+// Dial 使用DefaultDialer建立连接
+func Dial(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return DefaultDialer.Dial(ctx, urlStr, requestHeader)
+}
+
+// Dial 建立WebSocket连接，urlStr 是 ws:// 或者 wss:// 开头的地址
+// 握手失败的时候会返回服务端的响应，方便排查问题
+func (d *Dialer) Dial(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, nil, errors.New("websocket: 地址必须是ws或者wss开头 " + urlStr)
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+	var netDialer net.Dialer
+	netConn, err := netDialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			_ = netConn.Close()
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if d.TLSClientConfig != nil {
+			cfg = d.TLSClientConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(netConn, cfg)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, nil, err
+		}
+		netConn = tlsConn
+	}
+
+	keyBytes := make([]byte, 16)
+	if _, err = rand.Read(keyBytes); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, values := range requestHeader {
+		req.Header[k] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(d.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if d.EnableCompression {
+		req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	if err = req.Write(netConn); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		return nil, resp, ErrBadHandshake
+	}
+	compress, err := acceptDeflateResponse(resp.Header)
+	if err != nil {
+		return nil, resp, err
+	}
+	if compress && !d.EnableCompression {
+		return nil, resp, errors.New("websocket: 服务端返回了没有请求的扩展")
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	success = true
+	return newConn(netConn, br, false, resp.Header.Get("Sec-WebSocket-Protocol"), compress), resp, nil
+}
@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+permessage-deflate【RFC 7692】就是把每个消息用deflate压缩之后再发送，压缩过的消息第一个帧会设置RSV1
+
+为了简单，我们只支持不使用上下文接管【no_context_takeover】的模式
+	每个消息都是单独压缩、单独解压的，不需要在连接上保存压缩的字典
+	压缩率会差一点，不过每个连接不用一直占着32KB的窗口，连接多的时候内存友好很多
+
+握手的时候客户端发送
+	Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits
+服务端同意的话回复
+	Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover
+*/
+
+// deflateTail 每个压缩的消息最后都是这四个字节，发送的时候需要去掉，解压的时候需要加回来
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock 一个空的、标记为最后一块的stored block，让flate.Reader知道数据结束了
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflateExtension 服务端同意压缩之后回复的扩展
+const deflateExtension = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+var errMessageTooBig = errors.New("websocket: 消息太大了")
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressMessage 压缩一个消息
+func compressMessage(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	// Flush 会在最后写一个空的stored block，也就是deflateTail
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompressMessage 解压一个消息，limit 限制解压之后的大小，防止压缩炸弹
+func decompressMessage(data []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(
+		bytes.NewReader(data),
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(deflateFinalBlock),
+	))
+	defer r.Close()
+	p, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) > limit {
+		return nil, errMessageTooBig
+	}
+	return p, nil
+}
+
+// negotiateDeflate 服务端判断客户端有没有提供一个我们能接受的permessage-deflate
+func negotiateDeflate(header http.Header) bool {
+	for _, ext := range parseExtensions(header) {
+		if ext.name != "permessage-deflate" {
+			continue
+		}
+		if acceptDeflateParams(ext.params) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptDeflateParams 判断permessage-deflate的参数我们能不能接受
+func acceptDeflateParams(params map[string]string) bool {
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+		case "server_max_window_bits":
+			// flate 固定使用32KB的窗口，也就是15，客户端要求更小的窗口我们做不到
+			if v != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// acceptDeflateResponse 客户端判断服务端同意的permessage-deflate我们能不能接受
+// 我们解压的时候不保存上下文，所以服务端必须同意server_no_context_takeover
+func acceptDeflateResponse(header http.Header) (bool, error) {
+	for _, ext := range parseExtensions(header) {
+		if ext.name != "permessage-deflate" {
+			return false, errors.New("websocket: 服务端返回了不支持的扩展 " + ext.name)
+		}
+		if _, ok := ext.params["server_no_context_takeover"]; !ok {
+			return false, errors.New("websocket: 服务端没有同意server_no_context_takeover")
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions 解析Sec-WebSocket-Extensions
+// permessage-deflate; client_max_window_bits, x-webkit-deflate-frame
+func parseExtensions(header http.Header) []extension {
+	var res []extension
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			ext := extension{name: strings.ToLower(name), params: map[string]string{}}
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(param, "=")
+				ext.params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+			}
+			res = append(res, ext)
+		}
+	}
+	return res
+}
@@ -0,0 +1,593 @@
+// Package websocket 基于net/http实现的WebSocket协议【RFC 6455】
+//
+// 这个包不依赖geek_web，可以单独使用，geek_web中的ctx.Upgrade只是对Upgrader的一层封装
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+WebSocket 的连接一开始是一个普通的HTTP请求，握手成功之后就和HTTP没有关系了
+后面双方都是通过帧【frame】来通信的，一个帧的格式如下
+
+	 0                   1                   2                   3
+	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	+-+-+-+-+-------+-+-------------+-------------------------------+
+	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+	| |1|2|3|       |K|             |                               |
+	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+	|     Extended payload length continued, if payload len == 127  |
+	+ - - - - - - - - - - - - - - - +-------------------------------+
+	|                               |Masking-key, if MASK set to 1  |
+	+-------------------------------+-------------------------------+
+	| Masking-key (continued)       |          Payload Data         |
+	+-------------------------------- - - - - - - - - - - - - - - - +
+
+需要注意的几个点
+	1. 客户端发送的帧必须使用掩码，服务端发送的帧不能使用掩码
+	2. 一个消息可以拆成多个帧发送【分片】，第一个帧是text或者binary，后面的都是continuation，最后一个帧FIN=1
+	3. 控制帧【close、ping、pong】不能分片，数据不能超过125个字节，但是可以插在分片的中间
+	4. RSV1 只有协商了permessage-deflate之后才能使用，表示这个消息是压缩过的
+*/
+
+// 消息类型，和帧的opcode一一对应
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// 关闭码，RFC 6455 7.4.1
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+)
+
+// maxControlFramePayloadSize 控制帧的数据最多125个字节
+const maxControlFramePayloadSize = 125
+
+// ErrCloseSent 已经发送过关闭帧了，不能再发送其他的帧
+var ErrCloseSent = errors.New("websocket: 已经发送过关闭帧")
+
+// CloseError 对方发送了关闭帧，或者因为协议错误我们主动关闭了连接
+type CloseError struct {
+	// Code 关闭码
+	Code int
+	// Text 关闭的原因
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// IsCloseError 判断err是不是指定关闭码的CloseError，没有指定关闭码的时候只判断是不是CloseError
+func IsCloseError(err error, codes ...int) bool {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return false
+	}
+	if len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		if closeErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatCloseMessage 生成关闭帧的数据
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		// 1005 只能用在本地表示没有收到关闭码，不能发送出去
+		return []byte{}
+	}
+	buf := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[2:], text)
+	return buf
+}
+
+// Conn WebSocket连接
+// 同一时间只能有一个goroutine读，一个goroutine写
+// WriteControl、WriteClose 可以和其他方法并发调用
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	isServer    bool
+	subprotocol string
+	// compress 是否协商了permessage-deflate
+	compress bool
+
+	// writeMu 保证一个帧是完整写出去的，读的时候自动回复pong也会写
+	writeMu   sync.Mutex
+	closeSent bool
+
+	readLimit   int64
+	readErr     error
+	pingHandler func(appData string) error
+	pongHandler func(appData string) error
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool, subprotocol string, compress bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	c := &Conn{
+		conn:        conn,
+		br:          br,
+		isServer:    isServer,
+		subprotocol: subprotocol,
+		compress:    compress,
+		readLimit:   DefaultReadLimit,
+	}
+	c.SetPingHandler(nil)
+	c.SetPongHandler(nil)
+	return c
+}
+
+// Subprotocol 握手时协商好的子协议
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compressed 握手时是否协商了permessage-deflate
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+// LocalAddr 本地地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr 对方的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline 设置读超时，超时之后连接就不能再用了
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置写超时，超时之后连接就不能再用了
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// DefaultReadLimit 默认一个消息最多多少字节
+// 帧的长度是对方说了算的，不限制的话，一个声称有2^62个字节的帧就能把进程的内存耗尽
+const DefaultReadLimit = 32 << 20
+
+// SetReadLimit 一个消息最多多少字节【分片的消息是全部分片加起来，压缩的消息是解压之后的大小】
+// 超过之后使用1009关闭连接，小于等于0的时候使用DefaultReadLimit
+func (c *Conn) SetReadLimit(limit int64) {
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+	c.readLimit = limit
+}
+
+// SetPingHandler 收到ping之后的处理函数，默认回复一个相同数据的pong
+func (c *Conn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			err := c.WriteControl(PongMessage, []byte(appData))
+			if err == ErrCloseSent {
+				return nil
+			}
+			return err
+		}
+	}
+	c.pingHandler = h
+}
+
+// SetPongHandler 收到pong之后的处理函数，默认什么都不做，一般用来刷新读超时
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(string) error { return nil }
+	}
+	c.pongHandler = h
+}
+
+// Close 直接关闭底层的连接，不会发送关闭帧
+// 正常关闭应该先调用WriteClose，等对方回复关闭帧【ReadMessage返回CloseError】之后再调用Close
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// WriteClose 发送关闭帧
+func (c *Conn) WriteClose(code int, text string) error {
+	return c.WriteControl(CloseMessage, FormatCloseMessage(code, text))
+}
+
+// WriteControl 发送控制帧
+func (c *Conn) WriteControl(messageType int, data []byte) error {
+	if !isControl(messageType) {
+		return fmt.Errorf("websocket: %d 不是控制帧", messageType)
+	}
+	if len(data) > maxControlFramePayloadSize {
+		return errors.New("websocket: 控制帧的数据不能超过125个字节")
+	}
+	return c.writeFrame(true, false, messageType, data)
+}
+
+// WriteMessage 发送一个完整的消息
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if isControl(messageType) {
+		return c.WriteControl(messageType, data)
+	}
+	if !isData(messageType) {
+		return fmt.Errorf("websocket: 未知的消息类型 %d", messageType)
+	}
+	if c.compress {
+		compressed, err := compressMessage(data)
+		if err != nil {
+			return err
+		}
+		return c.writeFrame(true, true, messageType, compressed)
+	}
+	return c.writeFrame(true, false, messageType, data)
+}
+
+// NextWriter 分片发送一个消息，每次Write都会发送一个帧，Close的时候发送最后一个帧
+// 适合一开始不知道消息有多大的场景，例如一边生成一边发送
+// 协商了压缩的时候，压缩需要用到整个消息，所以会先缓存起来，Close的时候一次性发送
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if !isData(messageType) {
+		return nil, fmt.Errorf("websocket: %d 不是数据帧", messageType)
+	}
+	return &messageWriter{c: c, messageType: messageType}, nil
+}
+
+type messageWriter struct {
+	c           *Conn
+	messageType int
+	started     bool
+	closed      bool
+	buf         []byte
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("websocket: 消息已经发送完了")
+	}
+	if w.c.compress {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.c.writeFrame(false, false, w.opcode(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.c.compress {
+		return w.c.WriteMessage(w.messageType, w.buf)
+	}
+	return w.c.writeFrame(true, false, w.opcode(), nil)
+}
+
+// opcode 第一个帧使用消息类型，后面的都是continuation
+func (w *messageWriter) opcode() int {
+	if w.started {
+		return continuationFrame
+	}
+	w.started = true
+	return w.messageType
+}
+
+// writeFrame 发送一个帧
+func (c *Conn) writeFrame(fin bool, rsv1 bool, opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	var b1 byte
+	if !c.isServer {
+		b1 = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, b0, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b0, b1|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[2:], uint16(length))
+	default:
+		buf = append(buf, b0, b1|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[2:], uint64(length))
+	}
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		// 客户端必须使用随机的掩码
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// ReadMessage 读取一个完整的消息，分片的消息会拼接起来，压缩的消息会解压
+// ping、pong会交给对应的处理函数，不会返回给调用方
+// 收到关闭帧之后会回复关闭帧，然后返回CloseError，之后再调用都会返回同一个错误
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	messageType, p, err = c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return messageType, p, err
+}
+
+func (c *Conn) readMessage() (int, []byte, error) {
+	var (
+		messageType int
+		compressed  bool
+		buf         []byte
+	)
+	for {
+		f, err := c.readFrame(int64(len(buf)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.opcode {
+		case PingMessage:
+			if err = c.pingHandler(string(f.payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if err = c.pongHandler(string(f.payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "没有开始的消息收到了continuation帧")
+			}
+			if f.rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation帧不能设置RSV1")
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "上一个消息还没有结束")
+			}
+			messageType = f.opcode
+			if f.rsv1 {
+				if !c.compress {
+					return 0, nil, c.fail(CloseProtocolError, "没有协商压缩却设置了RSV1")
+				}
+				compressed = true
+			}
+		}
+		buf = append(buf, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+	if compressed {
+		var err error
+		buf, err = decompressMessage(buf, c.readLimit)
+		if err == errMessageTooBig {
+			return 0, nil, c.fail(CloseMessageTooBig, "消息太大了")
+		}
+		if err != nil {
+			return 0, nil, c.fail(CloseInvalidFramePayloadData, "解压失败")
+		}
+	}
+	if buf == nil {
+		// 空消息也返回一个空的切片，而不是nil
+		buf = []byte{}
+	}
+	if messageType == TextMessage && !utf8.Valid(buf) {
+		return 0, nil, c.fail(CloseInvalidFramePayloadData, "文本消息不是合法的UTF-8")
+	}
+	return messageType, buf, nil
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  int
+	payload []byte
+}
+
+// readFrame 读取一个帧，并且校验帧的格式
+// buffered 当前消息前面的分片已经读了多少字节，数据帧的长度加上它不能超过readLimit
+func (c *Conn) readFrame(buffered int64) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return frame{}, c.readFailed(err)
+	}
+	f := frame{
+		fin:    head[0]&0x80 != 0,
+		rsv1:   head[0]&0x40 != 0,
+		opcode: int(head[0] & 0x0f),
+	}
+	if head[0]&0x30 != 0 {
+		return frame{}, c.fail(CloseProtocolError, "不支持RSV2、RSV3")
+	}
+	masked := head[1]&0x80 != 0
+	if masked != c.isServer {
+		if c.isServer {
+			return frame{}, c.fail(CloseProtocolError, "客户端发送的帧必须使用掩码")
+		}
+		return frame{}, c.fail(CloseProtocolError, "服务端发送的帧不能使用掩码")
+	}
+	if !isData(f.opcode) && !isControl(f.opcode) && f.opcode != continuationFrame {
+		return frame{}, c.fail(CloseProtocolError, "未知的opcode "+strconv.Itoa(f.opcode))
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, c.readFailed(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, c.readFailed(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, c.fail(CloseProtocolError, "帧的长度不合法")
+		}
+	}
+	if isControl(f.opcode) {
+		if !f.fin {
+			return frame{}, c.fail(CloseProtocolError, "控制帧不能分片")
+		}
+		if f.rsv1 {
+			return frame{}, c.fail(CloseProtocolError, "控制帧不能设置RSV1")
+		}
+		if length > maxControlFramePayloadSize {
+			return frame{}, c.fail(CloseProtocolError, "控制帧的数据不能超过125个字节")
+		}
+	} else if length > uint64(c.readLimit-buffered) {
+		// 分配内存之前就检查，还没读数据就已经知道太大了，没必要再读了
+		return frame{}, c.fail(CloseMessageTooBig, "消息太大了")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return frame{}, c.readFailed(err)
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return frame{}, c.readFailed(err)
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// handleClose 处理对方发送的关闭帧
+func (c *Conn) handleClose(payload []byte) error {
+	code := CloseNoStatusReceived
+	text := ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "关闭帧的数据不合法")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		if !isValidReceivedCloseCode(code) {
+			return c.fail(CloseProtocolError, "不合法的关闭码 "+strconv.Itoa(code))
+		}
+		text = string(payload[2:])
+		if !utf8.ValidString(text) {
+			return c.fail(CloseInvalidFramePayloadData, "关闭的原因不是合法的UTF-8")
+		}
+	}
+	// 回复一个关闭帧，我们主动关闭的时候已经发送过了，这里会返回ErrCloseSent，忽略就行
+	_ = c.WriteClose(code, "")
+	return &CloseError{Code: code, Text: text}
+}
+
+// fail 对方违反了协议，发送关闭帧之后返回错误
+func (c *Conn) fail(code int, text string) error {
+	_ = c.WriteClose(code, text)
+	return &CloseError{Code: code, Text: text}
+}
+
+// readFailed 连接在没有收到关闭帧的情况下断开了
+func (c *Conn) readFailed(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &CloseError{Code: CloseAbnormalClosure, Text: err.Error()}
+	}
+	return err
+}
+
+// isValidReceivedCloseCode 判断对方发送过来的关闭码是否合法，RFC 6455 7.4
+func isValidReceivedCloseCode(code int) bool {
+	switch code {
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData,
+		CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig,
+		CloseMandatoryExtension, CloseInternalServerErr:
+		return true
+	}
+	// 3000-3999 给库和框架使用，4000-4999 给应用使用
+	return code >= 3000 && code <= 4999
+}
+
+func isControl(opcode int) bool {
+	return opcode == CloseMessage || opcode == PingMessage || opcode == PongMessage
+}
+
+func isData(opcode int) bool {
+	return opcode == TextMessage || opcode == BinaryMessage
+}
+
+// maskBytes 掩码和解掩码是同一个操作，按字节异或
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// acceptGUID 计算Sec-WebSocket-Accept用的固定字符串，RFC 6455 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// HandshakeError 握手失败
+type HandshakeError struct {
+	message string
+}
+
+func (e HandshakeError) Error() string {
+	return "websocket: " + e.message
+}
+
+// Upgrader 把HTTP请求升级成WebSocket连接
+type Upgrader struct {
+	// HandshakeTimeout 写握手响应的超时时间，0表示不限制
+	HandshakeTimeout time.Duration
+	// Subprotocols 服务端支持的子协议，按照优先级排序
+	Subprotocols []string
+	// CheckOrigin 校验请求的Origin，默认只允许同源的请求，防止跨站WebSocket劫持
+	CheckOrigin func(r *http.Request) bool
+	// EnableCompression 客户端支持的时候，是否使用permessage-deflate压缩
+	EnableCompression bool
+	// ReadLimit 一个消息最多多少字节，0表示使用DefaultReadLimit
+	ReadLimit int64
+}
+
+// Upgrade 把HTTP请求升级成WebSocket连接
+// responseHeader 额外的响应头，例如Set-Cookie
+// 失败的时候会直接响应对应的HTTP错误，成功之后w就不能再使用了
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, u.returnError(w, http.StatusMethodNotAllowed, "请求方法必须是GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return nil, u.returnError(w, http.StatusBadRequest, "Connection请求头中没有upgrade")
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, u.returnError(w, http.StatusBadRequest, "Upgrade请求头中没有websocket")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.returnError(w, http.StatusUpgradeRequired, "只支持13版本的协议")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, u.returnError(w, http.StatusForbidden, "Origin校验失败")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.returnError(w, http.StatusBadRequest, "Sec-WebSocket-Key不合法")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, u.returnError(w, http.StatusInternalServerError, "ResponseWriter不支持Hijack")
+	}
+
+	subprotocol := u.selectSubprotocol(r)
+	compress := u.EnableCompression && negotiateDeflate(r.Header)
+
+	netConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// 客户端在收到握手响应之前是不能发送数据的
+	if brw.Reader.Buffered() > 0 {
+		_ = netConn.Close()
+		return nil, HandshakeError{message: "握手完成之前客户端就发送了数据"}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	sb.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n")
+	if subprotocol != "" {
+		sb.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if compress {
+		sb.WriteString("Sec-WebSocket-Extensions: " + deflateExtension + "\r\n")
+	}
+	for k, values := range responseHeader {
+		switch http.CanonicalHeaderKey(k) {
+		case "Upgrade", "Connection", "Sec-Websocket-Accept", "Sec-Websocket-Protocol", "Sec-Websocket-Extensions":
+			// 这几个响应头只能由握手决定
+			continue
+		}
+		for _, v := range values {
+			// 防止响应头注入
+			v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+			sb.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	sb.WriteString("\r\n")
+
+	// http.Server 上设置的超时对WebSocket长连接没有意义，必须清掉
+	_ = netConn.SetDeadline(time.Time{})
+	if u.HandshakeTimeout > 0 {
+		_ = netConn.SetWriteDeadline(time.Now().Add(u.HandshakeTimeout))
+	}
+	if _, err = netConn.Write([]byte(sb.String())); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	if u.HandshakeTimeout > 0 {
+		_ = netConn.SetWriteDeadline(time.Time{})
+	}
+
+	c := newConn(netConn, brw.Reader, true, subprotocol, compress)
+	c.SetReadLimit(u.ReadLimit)
+	return c, nil
+}
+
+// returnError 握手失败的时候响应HTTP错误
+func (u *Upgrader) returnError(w http.ResponseWriter, status int, message string) error {
+	http.Error(w, http.StatusText(status), status)
+	return HandshakeError{message: message}
+}
+
+// selectSubprotocol 选择第一个客户端请求的、服务端也支持的子协议
+func (u *Upgrader) selectSubprotocol(r *http.Request) string {
+	for _, clientProtocol := range Subprotocols(r) {
+		for _, serverProtocol := range u.Subprotocols {
+			if clientProtocol == serverProtocol {
+				return clientProtocol
+			}
+		}
+	}
+	return ""
+}
+
+// Subprotocols 客户端请求的子协议
+func Subprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// IsWebSocketUpgrade 判断是不是WebSocket的握手请求
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// checkSameOrigin 没有Origin【不是浏览器发起的】或者Origin和Host一样的时候才允许
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// computeAcceptKey Sec-WebSocket-Accept = base64(sha1(key + GUID))
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken 判断请求头中是否包含某个token，不区分大小写
+// Connection: keep-alive, Upgrade
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoServer 把收到的消息原样发回去，服务端读到的错误会写到errs中
+func newEchoServer(t *testing.T, upgrader *Upgrader) (string, <-chan error) {
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Echo": {"1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err = conn.WriteMessage(mt, msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), errs
+}
+
+func TestEcho(t *testing.T) {
+	testCases := []struct {
+		name     string
+		upgrader *Upgrader
+		dialer   *Dialer
+		compress bool
+	}{
+		{name: "不压缩", upgrader: &Upgrader{EnableCompression: true}, dialer: &Dialer{}},
+		{name: "服务端不支持压缩", upgrader: &Upgrader{}, dialer: &Dialer{EnableCompression: true}},
+		{name: "压缩", upgrader: &Upgrader{EnableCompression: true}, dialer: &Dialer{EnableCompression: true}, compress: true},
+	}
+	messages := []struct {
+		mt   int
+		data []byte
+	}{
+		{mt: TextMessage, data: []byte("hello")},
+		{mt: TextMessage, data: []byte("")},
+		{mt: BinaryMessage, data: bytes.Repeat([]byte{1, 2, 3}, 100)},
+		{mt: TextMessage, data: []byte(strings.Repeat("你好", 20000))},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url, _ := newEchoServer(t, tc.upgrader)
+			conn, resp, err := tc.dialer.Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, "1", resp.Header.Get("X-Echo"))
+			assert.Equal(t, tc.compress, conn.Compressed())
+			for _, msg := range messages {
+				require.NoError(t, conn.WriteMessage(msg.mt, msg.data))
+				mt, data, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, msg.mt, mt)
+				assert.Equal(t, msg.data, data)
+			}
+		})
+	}
+}
+
+func TestFragmentationAndPing(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		url, _ := newEchoServer(t, &Upgrader{EnableCompression: compress})
+		conn, _, err := (&Dialer{EnableCompression: compress}).Dial(context.Background(), url, nil)
+		require.NoError(t, err)
+		pongs := make([]string, 0)
+		conn.SetPongHandler(func(appData string) error {
+			pongs = append(pongs, appData)
+			return nil
+		})
+
+		w, err := conn.NextWriter(TextMessage)
+		require.NoError(t, err)
+		_, _ = w.Write([]byte("hello "))
+		// 控制帧可以插在分片的中间
+		require.NoError(t, conn.WriteControl(PingMessage, []byte("ping")))
+		_, _ = w.Write([]byte("world"))
+		require.NoError(t, w.Close())
+
+		mt, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, TextMessage, mt)
+		assert.Equal(t, "hello world", string(data))
+		assert.Equal(t, []string{"ping"}, pongs)
+		_ = conn.Close()
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	url, errs := newEchoServer(t, &Upgrader{})
+	conn, _, err := Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteClose(CloseGoingAway, "bye"))
+	assert.Equal(t, ErrCloseSent, conn.WriteMessage(TextMessage, []byte("x")))
+	// 服务端收到关闭帧
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Text: "bye"}, <-errs)
+	// 客户端收到服务端回复的关闭帧
+	_, _, err = conn.ReadMessage()
+	assert.True(t, IsCloseError(err, CloseGoingAway))
+	// 之后一直返回同一个错误
+	_, _, err2 := conn.ReadMessage()
+	assert.Equal(t, err, err2)
+}
+
+func TestProtocolError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		frame    []byte
+		limit    int64
+		wantCode int
+	}{
+		{name: "没有掩码", frame: []byte{0x81, 0x02, 'h', 'i'}, wantCode: CloseProtocolError},
+		{name: "RSV2", frame: masked(0xa1, []byte("hi")), wantCode: CloseProtocolError},
+		{name: "未知的opcode", frame: masked(0x83, []byte("hi")), wantCode: CloseProtocolError},
+		{name: "控制帧分片", frame: masked(0x09, []byte("hi")), wantCode: CloseProtocolError},
+		{name: "控制帧太长", frame: masked(0x89, bytes.Repeat([]byte("a"), 126)), wantCode: CloseProtocolError},
+		{name: "没有开始的continuation", frame: masked(0x80, []byte("hi")), wantCode: CloseProtocolError},
+		{name: "没有协商压缩", frame: masked(0xc1, []byte("hi")), wantCode: CloseProtocolError},
+		{
+			name:     "上一个消息没有结束",
+			frame:    append(masked(0x01, []byte("a")), masked(0x81, []byte("b"))...),
+			wantCode: CloseProtocolError,
+		},
+		{name: "非法的UTF-8", frame: masked(0x81, []byte{0xff, 0xfe}), wantCode: CloseInvalidFramePayloadData},
+		{name: "非法的关闭码", frame: masked(0x88, []byte{0x03, 0xed}), wantCode: CloseProtocolError},
+		{name: "消息太大", frame: masked(0x82, bytes.Repeat([]byte("a"), 11)), limit: 10, wantCode: CloseMessageTooBig},
+		{
+			name:     "分片之后太大",
+			frame:    append(masked(0x02, bytes.Repeat([]byte("a"), 6)), masked(0x80, bytes.Repeat([]byte("a"), 6))...),
+			limit:    10,
+			wantCode: CloseMessageTooBig,
+		},
+		{
+			// 没有配置ReadLimit也有默认的限制，不会按照帧头里面的长度直接分配内存
+			name:     "帧头声称的长度太大",
+			frame:    []byte{0x82, 0x80 | 127, 0x40, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+			wantCode: CloseMessageTooBig,
+		},
+		{
+			name: "分片加起来超过默认的限制",
+			frame: append(masked(0x02, []byte("a")),
+				0x80, 0x80|127, 0, 0, 0, 0, 0x02, 0, 0, 0, 1, 2, 3, 4),
+			wantCode: CloseMessageTooBig,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url, errs := newEchoServer(t, &Upgrader{ReadLimit: tc.limit})
+			conn, _, err := Dial(context.Background(), url, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			// 直接往底层的连接写，绕过客户端的校验
+			_, err = conn.conn.Write(tc.frame)
+			require.NoError(t, err)
+			serverErr := <-errs
+			assert.True(t, IsCloseError(serverErr, tc.wantCode), serverErr)
+			_, _, err = conn.ReadMessage()
+			assert.True(t, IsCloseError(err, tc.wantCode), err)
+		})
+	}
+}
+
+// masked 生成一个客户端发送的帧，数据不超过125个字节
+func masked(b0 byte, payload []byte) []byte {
+	key := [4]byte{1, 2, 3, 4}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	frame = append(frame, key[:]...)
+	data := append([]byte{}, payload...)
+	maskBytes(key, data)
+	return append(frame, data...)
+}
+
+func TestUpgradeHandshakeError(t *testing.T) {
+	upgrader := &Upgrader{Subprotocols: []string{"chat"}}
+	validHeader := func() http.Header {
+		return http.Header{
+			"Connection":            {"keep-alive, Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		}
+	}
+	testCases := []struct {
+		name     string
+		method   string
+		header   func() http.Header
+		wantCode int
+	}{
+		{name: "不是GET", method: http.MethodPost, header: validHeader, wantCode: http.StatusMethodNotAllowed},
+		{name: "普通的请求", method: http.MethodGet, header: func() http.Header { return http.Header{} }, wantCode: http.StatusBadRequest},
+		{
+			name: "版本不对", method: http.MethodGet, wantCode: http.StatusUpgradeRequired,
+			header: func() http.Header {
+				header := validHeader()
+				header.Set("Sec-WebSocket-Version", "8")
+				return header
+			},
+		},
+		{
+			name: "跨域", method: http.MethodGet, wantCode: http.StatusForbidden,
+			header: func() http.Header {
+				header := validHeader()
+				header.Set("Origin", "http://evil.com")
+				return header
+			},
+		},
+		{
+			name: "非法的key", method: http.MethodGet, wantCode: http.StatusBadRequest,
+			header: func() http.Header {
+				header := validHeader()
+				header.Set("Sec-WebSocket-Key", "abc")
+				return header
+			},
+		},
+		// httptest.ResponseRecorder 不支持Hijack
+		{name: "不支持Hijack", method: http.MethodGet, header: validHeader, wantCode: http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/ws", nil)
+			req.Header = tc.header()
+			recorder := httptest.NewRecorder()
+			conn, err := upgrader.Upgrade(recorder, req, nil)
+			assert.Nil(t, conn)
+			assert.Error(t, err)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+		})
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	url, _ := newEchoServer(t, &Upgrader{Subprotocols: []string{"v2", "v1"}})
+	conn, _, err := (&Dialer{Subprotocols: []string{"v1", "v2"}}).Dial(context.Background(), url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "v1", conn.Subprotocol())
+}
+
+func TestCompressMessage(t *testing.T) {
+	for _, data := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("a"), 1<<16)} {
+		compressed, err := compressMessage(data)
+		require.NoError(t, err)
+		got, err := decompressMessage(compressed, DefaultReadLimit)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+	// 压缩炸弹
+	compressed, err := compressMessage(bytes.Repeat([]byte("a"), 1<<20))
+	require.NoError(t, err)
+	_, err = decompressMessage(compressed, 1<<10)
+	assert.Equal(t, errMessageTooBig, err)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// 服务端一直不回复握手
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	_, _, err := (&Dialer{HandshakeTimeout: 50 * time.Millisecond}).Dial(context.Background(),
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Error(t, err)
+}